@@ -2,11 +2,13 @@ package plexible
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +20,20 @@ import (
 // Time after which a subscribed controller is removed.
 const controllerTimeout = time.Second * 90
 
+// DefaultCommandTimeout is the default time a player has to handle a command.
+const DefaultCommandTimeout = time.Second * 10
+
+// DefaultAPIAddr is the default address the client API listens on. Port
+// 32500 is used by other Plex players.
+const DefaultAPIAddr = ":32500"
+
+// DefaultAnnounceInterval is the default interval between repeated discovery
+// announcements.
+const DefaultAnnounceInterval = time.Minute
+
+// Time allowed for in-flight API requests to complete during shutdown.
+const shutdownTimeout = time.Second * 5
+
 // ClientInfo contains static information about the client.
 type ClientInfo struct {
 	ID      string
@@ -31,8 +47,19 @@ type playerInfo struct {
 	Type         string
 	Capabilities []string
 	Timeline     *PlayerTimeline
+	PlayQueue    *PlayQueue
+	Media        *PlayMediaCommand // last PlayMediaCommand sent to the player
+	Streams      *selectedStreams
+	Reporter     *serverReporter
 	Timelines    <-chan *PlayerTimeline
-	Cmds         chan<- interface{}
+	Player       Player
+}
+
+// selectedStreams are the stream IDs a player accepted for an item, set by
+// one or more SetStreamsCommands.
+type selectedStreams struct {
+	key                                            string
+	audioStreamID, subtitleStreamID, videoStreamID *int
 }
 
 // A controller is a device that controls the client. It is either polling
@@ -95,6 +122,7 @@ func (c *subscribingController) Send(clientID string, mc *MediaContainer) error
 type pollingController struct {
 	clientID string
 	ch       chan *MediaContainer
+	sent     bool
 }
 
 func (c *pollingController) String() string {
@@ -105,7 +133,13 @@ func (c *pollingController) ClientID() string {
 	return c.clientID
 }
 
+// Send delivers the first timeline to the waiting request handler. ch must be
+// buffered so Send never blocks, even if the handler has already given up.
 func (c *pollingController) Send(clientID string, mc *MediaContainer) error {
+	if c.sent {
+		return nil
+	}
+	c.sent = true
 	c.ch <- mc
 	close(c.ch)
 	return nil
@@ -121,9 +155,30 @@ type Client struct {
 	// Logger, uses the logrus StandardLogger() by default.
 	Logger *logrus.Logger
 
+	// Time a player has to handle a command before the controller is sent
+	// a 503 response. Defaults to DefaultCommandTimeout.
+	CommandTimeout time.Duration
+
+	// Address the API listens on, advertised to controllers by discovery.
+	// Defaults to DefaultAPIAddr. Use port 0 for an OS-assigned port.
+	APIAddr string
+
+	// Address discovery requests are received on. Defaults to
+	// StandardClientDiscoveryAddr.
+	DiscoveryAddr *net.UDPAddr
+
+	// Network interface used for multicast discovery and announcements. The
+	// system default is used if nil.
+	Interface *net.Interface
+
+	// Interval between repeated announcements of the client to the network.
+	// Defaults to DefaultAnnounceInterval. If 0 the client is only announced
+	// when it starts or its name changes.
+	AnnounceInterval time.Duration
+
 	// API
-	apiListener *net.TCPListener
-	apiPort     int
+	apiServer *http.Server
+	apiPort   int
 
 	// Player
 	players     []*playerInfo
@@ -136,9 +191,24 @@ type Client struct {
 	// Discovery
 	discovery     *ClientDiscovery
 	discoveryConn *net.UDPConn
+	announcer     chan struct{}
+
+	// Guards changes to Info.Name
+	infoLock sync.Mutex
+
+	// Lifecycle. stopping is closed when Run starts shutting down and done
+	// when it has finished.
+	stopping <-chan struct{}
+	done     chan struct{}
 
-	// Service cleanup channel
-	shutdown chan bool
+	// Requests to media servers made on behalf of players, waited for
+	// before Run returns. See startServerRequest.
+	serverRequests     sync.WaitGroup
+	serverRequestsLock sync.Mutex
+
+	// Start/Stop state
+	cancel  context.CancelFunc
+	stopped chan error
 }
 
 func NewClient(info *ClientInfo, logger *logrus.Logger) *Client {
@@ -146,74 +216,207 @@ func NewClient(info *ClientInfo, logger *logrus.Logger) *Client {
 		logger = logrus.StandardLogger()
 	}
 	return &Client{
-		Info:     info,
-		Logger:   logger,
-		shutdown: make(chan bool),
+		Info:             info,
+		Logger:           logger,
+		CommandTimeout:   DefaultCommandTimeout,
+		APIAddr:          DefaultAPIAddr,
+		AnnounceInterval: DefaultAnnounceInterval,
+		done:             make(chan struct{}),
 	}
 }
 
+// AddPlayer registers a player that receives commands, as one of the
+// *Command types, on cmds and sends its state on timelines.
 func (c *Client) AddPlayer(playerType string, capabilities []string,
 	timelines <-chan *PlayerTimeline, cmds chan<- interface{}) {
+	c.RegisterPlayer(playerType, capabilities, NewChannelPlayer(cmds), timelines)
+}
+
+// RegisterPlayer registers a Player that sends its state on timelines.
+func (c *Client) RegisterPlayer(playerType string, capabilities []string,
+	player Player, timelines <-chan *PlayerTimeline) {
 	c.playersLock.Lock()
 	defer c.playersLock.Unlock()
-	p := &playerInfo{playerType, capabilities, nil, timelines, cmds}
+	p := &playerInfo{
+		Type:         playerType,
+		Capabilities: capabilities,
+		Timelines:    timelines,
+		Player:       player,
+	}
 	c.players = append(c.players, p)
+
+	// Reporting to the media server can be slow, so it's done on its own
+	// goroutine to avoid blocking the player. Only the latest timeline is
+	// waiting to be reported.
+	reports := make(chan *PlayerTimeline, 1)
 	go func() {
 		c.Logger.Debugf("player %v timeline subscription started", playerType)
-		defer c.Logger.Errorf("player %v timeline subscription ended", playerType)
+		defer c.Logger.Debugf("player %v timeline subscription ended", playerType)
+		defer close(reports)
 		for {
-			if t, ok := <-timelines; ok {
+			select {
+			case t, ok := <-timelines:
+				if !ok {
+					return
+				}
 				c.Logger.Debugf("timeline %v from player %v", t, playerType)
+				c.playersLock.Lock()
 				p.Timeline = t
+				c.playersLock.Unlock()
 				c.notifyControllers()
-			} else {
+				select {
+				case <-reports:
+				default:
+				}
+				reports <- t
+			case <-c.done:
 				return
 			}
 		}
 	}()
+	go func() {
+		for t := range reports {
+			r := c.reporter(p)
+			if r == nil {
+				continue
+			}
+			ctx, done, ok := c.startServerRequest()
+			if !ok {
+				continue
+			}
+			r.Report(ctx, t)
+			done()
+		}
+	}()
+}
+
+// SetName changes the client's name, re-announcing the client to the network
+// if it is running.
+func (c *Client) SetName(name string) {
+	c.infoLock.Lock()
+	c.Info.Name = name
+	discovery := c.discovery
+	c.infoLock.Unlock()
+	if discovery != nil {
+		discovery.SetName(name)
+	}
+}
+
+func (c *Client) name() string {
+	c.infoLock.Lock()
+	defer c.infoLock.Unlock()
+	return c.Info.Name
+}
+
+// Run starts the client's API, discovery and announcements, and runs until
+// ctx is done or a service fails. It then shuts everything down, waiting for
+// in-flight API requests, and returns the first error. A Client cannot be run
+// again once Run has returned.
+func (c *Client) Run(ctx context.Context) error {
+	return c.run(ctx, nil)
 }
 
+// Start runs the client in the background until Stop is called.
 func (c *Client) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- c.run(ctx, func() { close(ready) })
+	}()
+	select {
+	case <-ready:
+		c.cancel, c.stopped = cancel, stopped
+		return nil
+	case err := <-stopped:
+		cancel()
+		return err
+	}
+}
+
+// Stop stops a client started with Start and returns the error, if any, that
+// the client stopped with.
+func (c *Client) Stop() error {
+	if c.cancel == nil {
+		return errors.New("client not started")
+	}
+	c.cancel()
+	err := <-c.stopped
+	c.cancel, c.stopped = nil, nil
+	return err
+}
+
+// run implements Run, calling ready, if not nil, once all services have
+// started.
+func (c *Client) run(ctx context.Context, ready func()) error {
+
+	select {
+	case <-c.done:
+		return errors.New("cannot start: client has already run")
+	default:
+	}
+	defer close(c.done)
 
 	if c.players == nil {
 		return errors.New("cannot start: no players added")
 	}
 
-	// Start services.
-	err := startClientAPI(c)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.stopping = ctx.Done()
+
+	// Services report fatal errors here.
+	errs := make(chan error, 2)
+
+	// Start services. Each is stopped, in reverse order, when run returns,
+	// after cancelling ctx to release any waiting requests.
+	defer c.forgetControllers()
+	defer c.waitServerRequests()
+	err := c.startClientAPI(errs)
 	if err != nil {
 		return fmt.Errorf("error starting api (%s)", err)
 	}
-	err = c.startClientDiscovery()
+	defer c.stopClientAPI()
+
+	err = c.startClientDiscovery(errs)
 	if err != nil {
-		return fmt.Errorf("error starting api (%s)", err)
+		return fmt.Errorf("error starting discovery (%s)", err)
 	}
+	defer c.stopClientDiscovery()
+	defer cancel()
 
 	err = c.discovery.Hello(nil)
 	if err != nil {
 		return fmt.Errorf("error sending hello (%s)", err)
 	}
+	c.announcer = make(chan struct{})
+	go func() {
+		defer close(c.announcer)
+		c.discovery.Announce(ctx, c.AnnounceInterval)
+	}()
 
-	return nil
-}
+	if ready != nil {
+		ready()
+	}
 
-func (c *Client) Stop() error {
-	c.discoveryConn.Close()
-	c.discovery.Bye(nil)
-	c.apiListener.Close()
-	<-c.shutdown
-	return nil
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
 }
 
-func startClientAPI(c *Client) error {
+func (c *Client) startClientAPI(errs chan<- error) error {
 
 	api := http.NewServeMux()
 
 	api.HandleFunc("/resources", func(w http.ResponseWriter, r *http.Request) {
-		players := make([]player, len(c.players))
+		name := c.name()
+		players := make([]player, 0, len(c.players))
 		for _, p := range c.players {
 			players = append(players, player{
-				Title:                c.Info.Name,
+				Title:                name,
 				MachineIdentifier:    c.Info.ID,
 				Product:              c.Info.Product,
 				Version:              c.Info.Version,
@@ -239,13 +442,15 @@ func startClientAPI(c *Client) error {
 		// Block until there's a timeline update or the timeout expires.
 		if wait {
 			c.Logger.Debugf("waiting for timeline update")
-			ch := make(chan *MediaContainer)
+			ch := make(chan *MediaContainer, 1)
 			rc := c.registerPollingController(controllerID, ch, commandID)
 			defer c.forgetController(controllerID)
 			select {
 			case mc = <-ch:
 				commandID = rc.commandID
 			case <-time.After(time.Second * 30):
+			case <-r.Context().Done():
+			case <-c.stopping:
 			}
 		}
 
@@ -257,10 +462,7 @@ func startClientAPI(c *Client) error {
 		msg, _ := xml.Marshal(mc)
 		c.Logger.Debugf("poll response: %q", msg)
 
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Access-Control-Expose-Headers", "X-Plex-Client-Identifier")
-		w.Header().Add("X-Plex-Client-Identifier", c.Info.ID)
-		w.Header().Add("X-Plex-Protocol", "1.0")
+		c.writeHeaders(w)
 		w.Header().Add("Content-Type", "text/xml; charset=utf-8")
 		w.Write(msg)
 	})
@@ -275,42 +477,139 @@ func startClientAPI(c *Client) error {
 		key := r.FormValue("key")
 		offset, _ := strconv.ParseUint(r.FormValue("offset"), 10, 64)
 
-		serverURL := fmt.Sprintf("%s://%s:%s", r.FormValue("protocol"),
-			r.FormValue("address"), r.FormValue("port"))
-		url := fmt.Sprintf("%s%s", serverURL, containerKey)
+		server := c.serverClient(r)
+		c.Logger.Debugf("fetching play media from %s%s", server.BaseURL, containerKey)
+		mc, err := server.Get(r.Context(), containerKey, nil)
+		if err != nil {
+			c.writeError(w, http.StatusBadGateway,
+				"error retrieving media container from %s%s (%s)",
+				server.BaseURL, containerKey, err)
+			return
+		}
+
+		playerType := mediaType(mc)
+		if playerType == "" {
+			c.writeError(w, http.StatusInternalServerError,
+				"can't determine type of player")
+			return
+		}
+
+		player := c.playerForType(playerType)
+		if player == nil {
+			c.writeError(w, http.StatusNotFound, "no player for type %s", playerType)
+			return
+		}
+		queue := NewPlayQueue(server, containerKey, key, mc)
+		cmd := &PlayMediaCommand{
+			ServerURL:         server.BaseURL,
+			Token:             server.Token,
+			MachineIdentifier: r.FormValue("machineIdentifier"),
+			MediaContainer:    mc,
+			PlayQueue:         queue,
+			ContainerKey:      containerKey,
+			Key:               key,
+			Offset:            offset,
+		}
+		ctx, cancel := c.commandContext(r)
+		defer cancel()
+		err = player.Player.PlayMedia(ctx, cmd)
+		// Only a player that accepted the media is playing it.
+		if err == nil {
+			c.setPlayQueue(player, queue)
+			c.setReporter(player, newServerReporter(server, c.Logger))
+			c.setMedia(player, cmd)
+		}
+		c.writeResult(w, err)
+	})
+
+	api.HandleFunc("/player/mirror/details", func(w http.ResponseWriter, r *http.Request) {
+
+		controllerID := r.Header.Get("X-Plex-Client-Identifier")
+		commandID := r.FormValue("commandID")
+		c.updateControllerCommandID(controllerID, commandID)
+
+		key := r.FormValue("key")
+		if key == "" {
+			c.writeError(w, http.StatusBadRequest, "missing mirror key")
+			return
+		}
 
-		c.Logger.Debugf("fetching play media from %s", url)
-		mc := &MediaContainer{}
-		err := getXML(url, mc)
+		server := c.serverClient(r)
+		c.Logger.Debugf("fetching mirror details from %s%s", server.BaseURL, key)
+		mc, err := server.Get(r.Context(), key, nil)
 		if err != nil {
-			c.Logger.Errorf("error retrieving media container from %s (%s)", url, err)
-			// TODO: return error
+			c.writeError(w, http.StatusBadGateway,
+				"error retrieving media container from %s%s (%s)",
+				server.BaseURL, key, err)
 			return
 		}
 
-		var playerType string
-		switch {
-		case mc.Tracks != nil:
-			playerType = TypeMusic
-		default:
-			c.Logger.Errorf("can't determine type of player")
-			// TODO: return error
+		// Details of an album or show are a container of Directories.
+		if mediaType(mc) == "" && mc.Directories == nil {
+			c.writeError(w, http.StatusBadGateway,
+				"no media or directories in %s%s", server.BaseURL, key)
+			return
+		}
+
+		player := c.playerForCapability(CapabilityMirror)
+		if player == nil {
+			c.writeError(w, http.StatusNotFound, "no mirror player")
+			return
+		}
+		mirror, ok := player.Player.(Mirror)
+		if !ok {
+			c.writeError(w, http.StatusNotFound, "no mirror player")
+			return
+		}
+		ctx, cancel := c.commandContext(r)
+		defer cancel()
+		err = mirror.MirrorDetails(ctx, &MirrorDetailsCommand{
+			ServerURL:         server.BaseURL,
+			Token:             server.Token,
+			MachineIdentifier: r.FormValue("machineIdentifier"),
+			Key:               key,
+			MediaContainer:    mc,
+		})
+		c.writeResult(w, err)
+	})
+
+	api.HandleFunc("/player/playback/refreshPlayQueue", func(w http.ResponseWriter, r *http.Request) {
+
+		controllerID := r.Header.Get("X-Plex-Client-Identifier")
+		commandID := r.FormValue("commandID")
+		c.updateControllerCommandID(controllerID, commandID)
+
+		id, err := strconv.Atoi(r.FormValue("playQueueID"))
+		if err != nil {
+			c.writeError(w, http.StatusBadRequest,
+				"invalid playQueueID %q", r.FormValue("playQueueID"))
 			return
 		}
 
+		playerType := r.FormValue("type")
 		player := c.playerForType(playerType)
 		if player == nil {
-			c.Logger.Warnf("no player for type %s", playerType)
-			// TODO: return error
+			c.writeError(w, http.StatusNotFound, "no player for type %s", playerType)
 			return
 		}
-		player.Cmds <- &PlayMediaCommand{
-			serverURL,
-			mc,
-			containerKey,
-			key,
-			offset,
+
+		queue := c.playQueue(player)
+		if queue == nil || queue.ID() != id {
+			c.writeError(w, http.StatusNotFound,
+				"no play queue %d for type %s", id, playerType)
+			return
 		}
+
+		c.Logger.Debugf("refreshing play queue %d", id)
+		if err := queue.Refresh(r.Context()); err != nil {
+			c.writeError(w, http.StatusBadGateway,
+				"error refreshing play queue %d (%s)", id, err)
+			return
+		}
+
+		ctx, cancel := c.commandContext(r)
+		defer cancel()
+		c.writeResult(w, player.Player.RefreshPlayQueue(ctx, queue))
 	})
 
 	api.HandleFunc("/player/playback/", func(w http.ResponseWriter, r *http.Request) {
@@ -320,35 +619,145 @@ func startClientAPI(c *Client) error {
 		c.updateControllerCommandID(controllerID, commandID)
 
 		cmdType := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
-		var cmd interface{}
+		var cmd func(context.Context, Player) error
+		var streams *SetStreamsCommand
 		switch cmdType {
 		case "pause":
-			cmd = &PauseCommand{}
+			cmd = func(ctx context.Context, p Player) error { return p.Pause(ctx) }
 		case "play":
-			cmd = &PlayCommand{}
+			cmd = func(ctx context.Context, p Player) error { return p.Play(ctx) }
 		case "stop":
-			cmd = &StopCommand{}
+			cmd = func(ctx context.Context, p Player) error { return p.Stop(ctx) }
+		case "seekTo":
+			offset, err := strconv.ParseUint(r.FormValue("offset"), 10, 64)
+			if err != nil {
+				c.writeError(w, http.StatusBadRequest,
+					"invalid seekTo offset %q", r.FormValue("offset"))
+				return
+			}
+			cmd = func(ctx context.Context, p Player) error { return p.Seek(ctx, offset) }
+		case "skipNext":
+			cmd = func(ctx context.Context, p Player) error { return p.SkipNext(ctx) }
+		case "skipPrevious":
+			cmd = func(ctx context.Context, p Player) error { return p.SkipPrevious(ctx) }
+		case "skipTo":
+			key := r.FormValue("key")
+			if key == "" {
+				c.writeError(w, http.StatusBadRequest, "missing skipTo key")
+				return
+			}
+			cmd = func(ctx context.Context, p Player) error { return p.SkipTo(ctx, key) }
+		case "setParameters":
+			params := &SetParametersCommand{}
+			err := optionalInts(r, []optionalInt{
+				{"volume", &params.Volume},
+				{"shuffle", &params.Shuffle},
+				{"repeat", &params.Repeat},
+			})
+			if err != nil {
+				c.writeError(w, http.StatusBadRequest, "invalid setParameters %s", err)
+				return
+			}
+			cmd = func(ctx context.Context, p Player) error { return p.SetParameters(ctx, params) }
+		case "setStreams":
+			streams = &SetStreamsCommand{}
+			err := optionalInts(r, []optionalInt{
+				{"audioStreamID", &streams.AudioStreamID},
+				{"subtitleStreamID", &streams.SubtitleStreamID},
+				{"videoStreamID", &streams.VideoStreamID},
+			})
+			if err != nil {
+				c.writeError(w, http.StatusBadRequest, "invalid setStreams %s", err)
+				return
+			}
+			cmd = func(ctx context.Context, p Player) error { return p.SetStreams(ctx, streams) }
 		default:
-			c.Logger.Warnf("unrecognised player command %s", cmdType)
-			// TODO: return error
+			c.writeError(w, http.StatusNotFound,
+				"unrecognised player command %s", cmdType)
 			return
 		}
 
 		playerType := r.FormValue("type")
 		player := c.playerForType(playerType)
 		if player == nil {
-			c.Logger.Warnf("no player for type %s", playerType)
-			// TODO: return error
+			c.writeError(w, http.StatusNotFound, "no player for type %s", playerType)
 			return
 		}
 
-		player.Cmds <- cmd
+		ctx, cancel := c.commandContext(r)
+		defer cancel()
+		err := cmd(ctx, player.Player)
+		if err == nil && streams != nil {
+			c.setStreams(player, streams)
+			c.saveStreams(player, streams)
+		}
+		c.writeResult(w, err)
+	})
+
+	api.HandleFunc("/player/navigation/", func(w http.ResponseWriter, r *http.Request) {
+
+		controllerID := r.Header.Get("X-Plex-Client-Identifier")
+		commandID := r.FormValue("commandID")
+		c.updateControllerCommandID(controllerID, commandID)
+
+		cmdType := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		var cmd interface{}
+		switch cmdType {
+		case "moveUp":
+			cmd = &MoveUpCommand{}
+		case "moveDown":
+			cmd = &MoveDownCommand{}
+		case "moveLeft":
+			cmd = &MoveLeftCommand{}
+		case "moveRight":
+			cmd = &MoveRightCommand{}
+		case "select":
+			cmd = &SelectCommand{}
+		case "back":
+			cmd = &BackCommand{}
+		case "home":
+			cmd = &HomeCommand{}
+		case "music":
+			cmd = &MusicCommand{}
+		case "contextMenu":
+			cmd = &ContextMenuCommand{}
+		case "toggleOSD":
+			cmd = &ToggleOSDCommand{}
+		case "pageUp":
+			cmd = &PageUpCommand{}
+		case "pageDown":
+			cmd = &PageDownCommand{}
+		case "nextLetter":
+			cmd = &NextLetterCommand{}
+		case "previousLetter":
+			cmd = &PreviousLetterCommand{}
+		default:
+			c.writeError(w, http.StatusNotFound,
+				"unrecognised navigation command %s", cmdType)
+			return
+		}
+
+		player := c.playerForCapability(CapabilityNavigation)
+		if player == nil {
+			c.writeError(w, http.StatusNotFound, "no navigation player")
+			return
+		}
+
+		navigator, ok := player.Player.(Navigator)
+		if !ok {
+			c.writeError(w, http.StatusNotFound, "no navigation player")
+			return
+		}
+		ctx, cancel := c.commandContext(r)
+		defer cancel()
+		c.writeResult(w, navigator.Navigate(ctx, cmd))
 	})
 
 	api.HandleFunc("/player/timeline/subscribe", func(w http.ResponseWriter, r *http.Request) {
 		host, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			c.writeError(w, http.StatusBadRequest,
+				"invalid remote address %s", r.RemoteAddr)
 			return
 		}
 		controllerID := r.Header.Get("X-Plex-Client-Identifier")
@@ -378,52 +787,194 @@ func startClientAPI(c *Client) error {
 		}
 	}
 
-	l, err := net.ListenTCP("tcp", nil)
+	addr := c.APIAddr
+	if addr == "" {
+		addr = DefaultAPIAddr
+	}
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("error creating api socket (%s)", err)
 	}
-	c.apiListener = l
 
 	_, port, _ := net.SplitHostPort(l.Addr().String())
 	c.apiPort, _ = strconv.Atoi(port)
+	c.apiServer = &http.Server{Handler: http.HandlerFunc(optionsWrapper)}
 
 	go func() {
-		c.Logger.Infof("client API listening on %s", c.apiListener.Addr())
-		http.Serve(l, http.HandlerFunc(optionsWrapper))
-		c.Logger.Info("client api shutting down")
-		c.shutdown <- true
+		c.Logger.Infof("client API listening on %s", l.Addr())
+		err := c.apiServer.Serve(l)
+		if err != http.ErrServerClosed {
+			errs <- fmt.Errorf("api failed (%s)", err)
+		}
 	}()
 
 	return nil
 }
 
-func getXML(url string, v interface{}) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+// stopClientAPI stops the API, waiting a short time for in-flight requests to
+// complete.
+func (c *Client) stopClientAPI() {
+	c.Logger.Info("client api shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := c.apiServer.Shutdown(ctx); err != nil {
+		c.Logger.Warnf("error shutting down api (%s)", err)
 	}
-	defer resp.Body.Close()
-	err = xml.NewDecoder(resp.Body).Decode(v)
-	if err != nil {
-		return err
+}
+
+// writeHeaders adds the headers common to all client API responses.
+func (c *Client) writeHeaders(w http.ResponseWriter) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Expose-Headers", "X-Plex-Client-Identifier")
+	w.Header().Add("X-Plex-Client-Identifier", c.Info.ID)
+	w.Header().Add("X-Plex-Protocol", "1.0")
+}
+
+// writeResponse writes a Response with the given HTTP status code.
+func (c *Client) writeResponse(w http.ResponseWriter, code int, status string) {
+	msg, _ := xml.Marshal(&Response{Code: code, Status: status})
+	c.writeHeaders(w)
+	w.Header().Add("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(msg)
+}
+
+// writeOK writes a successful command response.
+func (c *Client) writeOK(w http.ResponseWriter) {
+	c.writeResponse(w, http.StatusOK, "OK")
+}
+
+// commandContext returns the context for a player command, cancelled when
+// the request ends or the command timeout expires.
+func (c *Client) commandContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := c.CommandTimeout
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// writeResult writes the response for the result of a player command.
+func (c *Client) writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		c.writeError(w, http.StatusServiceUnavailable, "player did not respond")
+	case errors.Is(err, context.Canceled):
+		// The controller went away, so there's no-one to tell.
+		c.Logger.Debugf("command cancelled by controller")
+		c.writeResponse(w, http.StatusServiceUnavailable, "command cancelled")
+	case err != nil:
+		c.writeError(w, http.StatusInternalServerError, "player error (%s)", err)
+	default:
+		c.writeOK(w)
+	}
+}
+
+// writeError logs an error and writes it as the response.
+func (c *Client) writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	status := fmt.Sprintf(format, args...)
+	if code >= http.StatusInternalServerError {
+		c.Logger.Errorf("%s", status)
+	} else {
+		c.Logger.Warnf("%s", status)
+	}
+	c.writeResponse(w, code, status)
+}
+
+// serverClient creates a ServerClient for the media server described by a
+// command's protocol, address, port and token parameters.
+func (c *Client) serverClient(r *http.Request) *ServerClient {
+	serverURL := fmt.Sprintf("%s://%s:%s", r.FormValue("protocol"),
+		r.FormValue("address"), r.FormValue("port"))
+	server := NewServerClient(serverURL, r.FormValue("token"))
+	server.ClientIdentifier = c.Info.ID
+	return server
+}
+
+// optionalInt is an optional integer form value, see optionalInts.
+type optionalInt struct {
+	name  string
+	value **int
+}
+
+// optionalInts parses the integer form values present in a request. Values
+// that are missing are left nil.
+func optionalInts(r *http.Request, params []optionalInt) error {
+	for _, p := range params {
+		s := r.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s %q", p.name, s)
+		}
+		*p.value = &v
 	}
 	return nil
 }
 
-func (c *Client) startClientDiscovery() error {
+// mediaType returns the type of player needed for the media in mc, or "" if
+// the container has no playable media.
+func mediaType(mc *MediaContainer) string {
+	switch {
+	case mc.Tracks != nil:
+		return TypeMusic
+	case mc.Videos != nil:
+		return TypeVideo
+	case mc.Photos != nil:
+		return TypePhoto
+	}
+	return ""
+}
+
+func (c *Client) startClientDiscovery(errs chan<- error) error {
 
-	discoveryConn, err := net.ListenUDP("udp", &StandardClientDiscoveryAddr)
+	addr := c.DiscoveryAddr
+	if addr == nil {
+		addr = &StandardClientDiscoveryAddr
+	}
+	discoveryConn, err := listenDiscovery(c.Interface, addr)
 	if err != nil {
 		return fmt.Errorf("error creating discovery udp socket (%s)", err)
 	}
 
+	// Discovery gets its own copy of Info so SetName can update it safely.
 	c.discoveryConn = discoveryConn
-	c.discovery = &ClientDiscovery{c.Info, c.apiPort, c.Logger}
-	go c.discovery.Serve(c.discoveryConn)
+	c.infoLock.Lock()
+	info := *c.Info
+	c.discovery = &ClientDiscovery{
+		Info:      &info,
+		Port:      c.apiPort,
+		Interface: c.Interface,
+		Logger:    c.Logger,
+	}
+	c.infoLock.Unlock()
+	go func() {
+		err := c.discovery.Serve(c.discoveryConn)
+		select {
+		case <-c.stopping:
+			// Closed by stopClientDiscovery.
+		default:
+			errs <- fmt.Errorf("discovery failed (%s)", err)
+		}
+	}()
 
 	return nil
 }
 
+// stopClientDiscovery stops responding to discovery requests and announces
+// the client's departure.
+func (c *Client) stopClientDiscovery() {
+	if c.announcer != nil {
+		<-c.announcer
+	}
+	c.discoveryConn.Close()
+	if err := c.discovery.Bye(nil); err != nil {
+		c.Logger.Warnf("error sending bye (%s)", err)
+	}
+}
+
 func (c *Client) updateControllerCommandID(clientID, commandID string) {
 	c.controllersLock.Lock()
 	defer c.controllersLock.Unlock()
@@ -446,18 +997,236 @@ func (c *Client) playerForType(t string) *playerInfo {
 	return nil
 }
 
+func (c *Client) playerForCapability(capability string) *playerInfo {
+	c.playersLock.Lock()
+	defer c.playersLock.Unlock()
+	for _, p := range c.players {
+		for _, pc := range p.Capabilities {
+			if pc == capability {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Client) setPlayQueue(p *playerInfo, q *PlayQueue) {
+	c.playersLock.Lock()
+	defer c.playersLock.Unlock()
+	p.PlayQueue = q
+}
+
+func (c *Client) playQueue(p *playerInfo) *PlayQueue {
+	c.playersLock.Lock()
+	defer c.playersLock.Unlock()
+	return p.PlayQueue
+}
+
+func (c *Client) setMedia(p *playerInfo, cmd *PlayMediaCommand) {
+	c.playersLock.Lock()
+	defer c.playersLock.Unlock()
+	p.Media = cmd
+}
+
+// startServerRequest registers a request to a media server made on behalf of
+// a player. It returns a context that is cancelled when the client stops, and
+// a function to call when the request is done. ok is false if the client is
+// stopping and the request should not be made.
+func (c *Client) startServerRequest() (ctx context.Context, done func(), ok bool) {
+	c.serverRequestsLock.Lock()
+	defer c.serverRequestsLock.Unlock()
+	select {
+	case <-c.stopping:
+		return nil, nil, false
+	default:
+	}
+	c.serverRequests.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		c.serverRequests.Done()
+	}, true
+}
+
+// waitServerRequests waits for outstanding server requests to finish. It
+// must only be called once c.stopping is closed.
+func (c *Client) waitServerRequests() {
+	// Any request started before stopping has been added by the time the
+	// lock is acquired, and any after is refused.
+	c.serverRequestsLock.Lock()
+	c.serverRequestsLock.Unlock()
+	c.serverRequests.Wait()
+}
+
+// saveStreams records the audio and subtitle streams selected by a player on
+// the server the item it is playing came from. The item is found in the play
+// queue by the key the player reports, as players may not move through the
+// queue. The request is made in the background and is cancelled if the client
+// stops.
+func (c *Client) saveStreams(p *playerInfo, cmd *SetStreamsCommand) {
+	if cmd.AudioStreamID == nil && cmd.SubtitleStreamID == nil {
+		return
+	}
+	c.playersLock.Lock()
+	timeline, queue := p.Timeline, p.PlayQueue
+	c.playersLock.Unlock()
+	if timeline == nil || timeline.State == StateStopped || timeline.Key == "" ||
+		queue == nil || queue.Server == nil {
+		return
+	}
+	var part *Part
+	for _, item := range queue.Items() {
+		if item.Key() == timeline.Key && item.Media() != nil {
+			part = item.Media().Part
+			break
+		}
+	}
+	if part == nil || part.ID == 0 {
+		return
+	}
+	server, partID := queue.Server, part.ID
+
+	ctx, done, ok := c.startServerRequest()
+	if !ok {
+		return
+	}
+	go func() {
+		defer done()
+		ctx, cancel := context.WithTimeout(ctx, serverReportTimeout)
+		defer cancel()
+		err := server.SetStreams(ctx, partID, cmd.AudioStreamID, cmd.SubtitleStreamID)
+		if err != nil {
+			c.Logger.Errorf("error saving streams of part %d to %s: %s",
+				partID, server.BaseURL, err)
+		}
+	}()
+}
+
+// setStreams records the streams selected by a SetStreamsCommand the player
+// accepted for its current item.
+func (c *Client) setStreams(p *playerInfo, cmd *SetStreamsCommand) {
+	c.playersLock.Lock()
+	defer c.playersLock.Unlock()
+	if p.Timeline == nil || p.Timeline.Key == "" {
+		return
+	}
+	s := p.Streams
+	if s == nil || s.key != p.Timeline.Key {
+		s = &selectedStreams{key: p.Timeline.Key}
+		p.Streams = s
+	}
+	if cmd.AudioStreamID != nil {
+		s.audioStreamID = cmd.AudioStreamID
+	}
+	if cmd.SubtitleStreamID != nil {
+		s.subtitleStreamID = cmd.SubtitleStreamID
+	}
+	if cmd.VideoStreamID != nil {
+		s.videoStreamID = cmd.VideoStreamID
+	}
+}
+
+func (c *Client) setReporter(p *playerInfo, r *serverReporter) {
+	c.playersLock.Lock()
+	defer c.playersLock.Unlock()
+	p.Reporter = r
+}
+
+func (c *Client) reporter(p *playerInfo) *serverReporter {
+	c.playersLock.Lock()
+	defer c.playersLock.Unlock()
+	return p.Reporter
+}
+
 func (c *Client) collectTimelines() []Timeline {
 	c.playersLock.Lock()
 	defer c.playersLock.Unlock()
 	t := make([]Timeline, 0, len(c.players))
 	for _, p := range c.players {
 		if p.Timeline != nil {
-			t = append(t, Timeline{PlayerTimeline: p.Timeline, Type: p.Type})
+			pt := *p.Timeline
+			if pt.Controllable == nil {
+				pt.Controllable = controls(p.Capabilities, &pt)
+			}
+			if s := p.Streams; s != nil && s.key == pt.Key {
+				setStreamIDs(&pt, s)
+			}
+			tl := Timeline{PlayerTimeline: &pt, Type: p.Type}
+			if pt.State != StateStopped && p.Media != nil {
+				setServerAttributes(&tl, p.Media)
+			}
+			if q := p.PlayQueue; q != nil && q.ID() != 0 {
+				tl.PlayQueueID = q.ID()
+				tl.PlayQueueVersion = q.Version()
+				if item := q.Current(); item != nil {
+					tl.PlayQueueItemID = item.ID
+				}
+			}
+			t = append(t, tl)
 		}
 	}
 	return t
 }
 
+// setStreamIDs fills in the stream IDs the player did not report from the
+// streams it accepted.
+func setStreamIDs(t *PlayerTimeline, s *selectedStreams) {
+	if t.AudioStreamID == 0 && s.audioStreamID != nil {
+		t.AudioStreamID = *s.audioStreamID
+	}
+	if t.SubtitleStreamID == 0 && s.subtitleStreamID != nil {
+		t.SubtitleStreamID = *s.subtitleStreamID
+	}
+	if t.VideoStreamID == 0 && s.videoStreamID != nil {
+		t.VideoStreamID = *s.videoStreamID
+	}
+}
+
+// setServerAttributes fills in the timeline attributes describing the
+// server the player is playing media from.
+func setServerAttributes(t *Timeline, cmd *PlayMediaCommand) {
+	t.MachineIdentifier = cmd.MachineIdentifier
+	t.Token = cmd.Token
+	if u, err := url.Parse(cmd.ServerURL); err == nil {
+		t.Protocol = u.Scheme
+		t.Address = u.Hostname()
+		t.Port = u.Port()
+	}
+	if t.Duration > 0 {
+		t.SeekRange = fmt.Sprintf("0-%d", t.Duration)
+	}
+}
+
+// controls derives the list of controls a player supports from its
+// capabilities and the optional parameters it reports in its timeline.
+func controls(capabilities []string, t *PlayerTimeline) Controls {
+	var c Controls
+	for _, capability := range capabilities {
+		if capability == CapabilityPlayback {
+			c = append(c, ControlPlayPause, ControlStop, ControlSeekTo,
+				ControlSkipPrevious, ControlSkipNext)
+			break
+		}
+	}
+	if t.Volume != nil {
+		c = append(c, ControlVolume)
+	}
+	if t.Shuffle != nil {
+		c = append(c, ControlShuffle)
+	}
+	if t.Repeat != nil {
+		c = append(c, ControlRepeat)
+	}
+	return c
+}
+
 func (c *Client) registerSubscribingController(clientID, url, commandID string) *registeredController {
 	c.controllersLock.Lock()
 	defer c.controllersLock.Unlock()
@@ -512,6 +1281,18 @@ func (c *Client) forgetController(clientID string) {
 	}
 }
 
+// forgetControllers removes all controllers, stopping their timeouts.
+func (c *Client) forgetControllers() {
+	c.controllersLock.Lock()
+	defer c.controllersLock.Unlock()
+	for _, rc := range c.controllers {
+		if rc.timeout != nil {
+			rc.timeout.Stop()
+		}
+	}
+	c.controllers = nil
+}
+
 func (c *Client) notifyControllers() {
 	c.controllersLock.Lock()
 	defer c.controllersLock.Unlock()
@@ -531,12 +1312,57 @@ func (c *Client) SendTimeline(rc *registeredController, t []Timeline) error {
 	return err
 }
 
+// timelineTypes are the types of the timelines reported to controllers, in
+// order.
+var timelineTypes = []string{TypeMusic, TypeVideo, TypePhoto}
+
+// makeTimeline creates the timeline response for a controller. It always
+// includes one timeline of each type, synthesizing a stopped timeline for any
+// type with no active player.
 func makeTimeline(clientID, commandID string, timeline []Timeline) *MediaContainer {
+	timelines := make([]Timeline, 0, len(timelineTypes))
+	for _, playerType := range timelineTypes {
+		t := Timeline{
+			PlayerTimeline: &PlayerTimeline{State: StateStopped},
+			Type:           playerType,
+		}
+		for _, pt := range timeline {
+			if pt.Type == playerType && pt.PlayerTimeline != nil {
+				t = pt
+				break
+			}
+		}
+		timelines = append(timelines, t)
+	}
 	return &MediaContainer{
 		MachineIdentifier: clientID,
 		CommandID:         commandID,
-		Timelines:         timeline,
+		Location:          location(timelines),
+		Timelines:         timelines,
+	}
+}
+
+// location returns the location of the first active player or, if no player
+// is active, LocationNavigation. An active player that doesn't report its
+// location is assumed to be showing its media full screen.
+func location(timeline []Timeline) string {
+	for _, t := range timeline {
+		if t.PlayerTimeline == nil || t.State == StateStopped {
+			continue
+		}
+		if t.Location != "" {
+			return t.Location
+		}
+		switch t.Type {
+		case TypeMusic:
+			return LocationFullScreenMusic
+		case TypeVideo:
+			return LocationFullScreenVideo
+		case TypePhoto:
+			return LocationFullScreenPhoto
+		}
 	}
+	return LocationNavigation
 }
 
 /*
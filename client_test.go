@@ -0,0 +1,178 @@
+package plexible
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// streamsServer is a stand-in media server with a two track album. It reports
+// each PUT to a part on puts.
+func streamsServer(t *testing.T) (*httptest.Server, <-chan string) {
+	puts := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			if token := r.Header.Get("X-Plex-Token"); token != "token" {
+				t.Errorf("X-Plex-Token = %q, want token", token)
+			}
+			puts <- r.URL.Path + "?" + r.URL.RawQuery
+			return
+		}
+		if r.URL.Path == "/library/metadata/10/children" {
+			fmt.Fprint(w, `<MediaContainer>`+
+				`<Track key="/library/metadata/1" ratingKey="1" duration="1000"><Media><Part id="101" key="/parts/101"/></Media></Track>`+
+				`<Track key="/library/metadata/2" ratingKey="2" duration="1000"><Media><Part id="102" key="/parts/102"/></Media></Track>`+
+				`</MediaContainer>`)
+			return
+		}
+		fmt.Fprint(w, `<MediaContainer/>`)
+	}))
+	return server, puts
+}
+
+// startStreamsClient starts a Client with a music player that keeps its own
+// track list, like a legacy channel player, and never moves through the play
+// queue. It rejects SetStreamsCommands selecting audio stream 99.
+func startStreamsClient(t *testing.T) *Controller {
+
+	c := NewClient(&ClientInfo{ID: "test-client", Name: "test"}, nil)
+	c.APIAddr = "127.0.0.1:0"
+	c.DiscoveryAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	c.AnnounceInterval = 0
+
+	cmds := make(chan interface{})
+	timelines := make(chan *PlayerTimeline)
+	c.RegisterPlayer(TypeMusic, []string{CapabilityTimeline, CapabilityPlayback},
+		NewAckChannelPlayer(cmds), timelines)
+
+	go func() {
+		tracks := []string{"/library/metadata/1", "/library/metadata/2"}
+		state, track := StateStopped, 0
+		for cmd := range cmds {
+			var err error
+			switch v := cmd.(type) {
+			case *PlayMediaCommand:
+				state, track = StatePlaying, 0
+			case *SkipNextCommand:
+				track++
+			case *StopCommand:
+				state = StateStopped
+			case *SetStreamsCommand:
+				if v.AudioStreamID != nil && *v.AudioStreamID == 99 {
+					err = errors.New("unsupported stream")
+				}
+			}
+			cmd.(Acker).Ack(err)
+			select {
+			case timelines <- &PlayerTimeline{State: state, Key: tracks[track]}:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	t.Cleanup(func() { c.Stop() })
+
+	return &Controller{
+		ID:        "test-controller",
+		PlayerURL: "http://127.0.0.1:" + strconv.Itoa(c.apiPort),
+	}
+}
+
+// waitForState polls until the client reports the music player's state and
+// key.
+func waitForState(t *testing.T, ctl *Controller, state, key string) {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		mc, err := ctl.Poll(context.Background(), false)
+		if err != nil {
+			t.Fatalf("Poll: %s", err)
+		}
+		tl := musicTimeline(t, mc)
+		if tl.State == state && tl.Key == key {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("player did not reach state %s with key %s", state, key)
+}
+
+func expectPut(t *testing.T, puts <-chan string, want string) {
+	select {
+	case got := <-puts:
+		if got != want {
+			t.Errorf("PUT %s, want %s", got, want)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("no PUT, want %s", want)
+	}
+}
+
+func expectNoPut(t *testing.T, puts <-chan string) {
+	select {
+	case got := <-puts:
+		t.Errorf("unexpected PUT %s", got)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestClientSavesStreams(t *testing.T) {
+
+	server, puts := streamsServer(t)
+	defer server.Close()
+	ctl := startStreamsClient(t)
+	ctx := context.Background()
+
+	streams := func(audio, subtitle int) *SetStreamsCommand {
+		return &SetStreamsCommand{AudioStreamID: &audio, SubtitleStreamID: &subtitle}
+	}
+
+	err := ctl.PlayMedia(ctx, NewServerClient(server.URL, "token"), "server",
+		"/library/metadata/10/children", "/library/metadata/1", 0)
+	if err != nil {
+		t.Fatalf("PlayMedia: %s", err)
+	}
+	waitForState(t, ctl, StatePlaying, "/library/metadata/1")
+
+	// Accepted selections are saved to the playing item's part.
+	if err := ctl.SetStreams(ctx, TypeMusic, streams(5, 0)); err != nil {
+		t.Fatalf("SetStreams: %s", err)
+	}
+	expectPut(t, puts, "/library/parts/101?audioStreamID=5&subtitleStreamID=0")
+
+	// The part is the one the player is playing, even though it hasn't
+	// moved through the play queue.
+	if err := ctl.SkipNext(ctx, TypeMusic); err != nil {
+		t.Fatalf("SkipNext: %s", err)
+	}
+	waitForState(t, ctl, StatePlaying, "/library/metadata/2")
+	if err := ctl.SetStreams(ctx, TypeMusic, streams(6, 7)); err != nil {
+		t.Fatalf("SetStreams: %s", err)
+	}
+	expectPut(t, puts, "/library/parts/102?audioStreamID=6&subtitleStreamID=7")
+
+	// Rejected selections are not saved.
+	if err := ctl.SetStreams(ctx, TypeMusic, streams(99, 0)); err == nil {
+		t.Error("SetStreams succeeded, want player error")
+	}
+	expectNoPut(t, puts)
+
+	// Nor are selections made while stopped.
+	if err := ctl.Stop(ctx, TypeMusic); err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+	waitForState(t, ctl, StateStopped, "/library/metadata/2")
+	if err := ctl.SetStreams(ctx, TypeMusic, streams(5, 0)); err != nil {
+		t.Fatalf("SetStreams: %s", err)
+	}
+	expectNoPut(t, puts)
+}
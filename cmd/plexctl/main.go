@@ -0,0 +1,389 @@
+// Command plexctl discovers and remote-controls Plex servers and players.
+//
+// Usage:
+//
+//	plexctl [flags] servers
+//	plexctl [flags] players
+//	plexctl [flags] resources <player>
+//	plexctl [flags] play <player> <server> <key>
+//	plexctl [flags] pause|resume|stop <player>
+//	plexctl [flags] seek <player> <offset>
+//	plexctl [flags] watch <player>
+//
+// A player or server is given by name, resource identifier or URL, e.g.
+// http://192.168.1.3:32500. Names and identifiers are resolved by discovery.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/emgee/plexible"
+)
+
+var (
+	jsonFlag      = flag.Bool("json", false, "print results as JSON")
+	timeoutFlag   = flag.Duration("discovery-timeout", time.Second*2, "how long to wait for discovery responses")
+	typeFlag      = flag.String("type", plexible.TypeMusic, "player type for playback commands (music|video|photo)")
+	tokenFlag     = flag.String("token", "", "server access token")
+	containerFlag = flag.String("container", "", "container key for play, defaults to the item key")
+	listenFlag    = flag.String("listen", ":0", "timeline listen address for watch")
+	idFlag        = flag.String("id", "", "controller identifier, defaults to plexctl-<hostname>")
+)
+
+func main() {
+
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Cancel on interrupt, which is how watch is stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	if err := run(ctx, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "plexctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: plexctl [flags] <command> [args]
+
+commands:
+  servers                       list servers on the network
+  players                       list players on the network
+  resources <player>            show a player's resources
+  play <player> <server> <key>  play an item from a server
+  pause|resume|stop <player>    control playback
+  seek <player> <offset>        seek to an offset, e.g. 1m30s
+  watch <player>                print timeline updates until interrupted
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func run(ctx context.Context, cmd string, args []string) error {
+
+	switch cmd {
+	case "servers":
+		if err := checkArgs(cmd, args, 0); err != nil {
+			return err
+		}
+		servers, err := plexible.DiscoverServers(ctx, *timeoutFlag)
+		if err != nil {
+			return err
+		}
+		return printServers(os.Stdout, servers)
+
+	case "players":
+		if err := checkArgs(cmd, args, 0); err != nil {
+			return err
+		}
+		players, err := plexible.DiscoverPlayers(ctx, *timeoutFlag)
+		if err != nil {
+			return err
+		}
+		return printPlayers(os.Stdout, players)
+
+	case "resources":
+		if err := checkArgs(cmd, args, 1); err != nil {
+			return err
+		}
+		ctl, err := controller(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		mc, err := ctl.Resources(ctx)
+		if err != nil {
+			return err
+		}
+		return printResources(os.Stdout, mc)
+
+	case "play":
+		if err := checkArgs(cmd, args, 3); err != nil {
+			return err
+		}
+		ctl, err := controller(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		server, machineIdentifier, err := serverClient(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		key := args[2]
+		containerKey := *containerFlag
+		if containerKey == "" {
+			containerKey = key
+		}
+		return ctl.PlayMedia(ctx, server, machineIdentifier, containerKey, key, 0)
+
+	case "pause", "resume", "stop":
+		if err := checkArgs(cmd, args, 1); err != nil {
+			return err
+		}
+		ctl, err := controller(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case "pause":
+			return ctl.Pause(ctx, *typeFlag)
+		case "resume":
+			return ctl.Play(ctx, *typeFlag)
+		default:
+			return ctl.Stop(ctx, *typeFlag)
+		}
+
+	case "seek":
+		if err := checkArgs(cmd, args, 2); err != nil {
+			return err
+		}
+		offset, err := time.ParseDuration(args[1])
+		if err != nil || offset < 0 {
+			return fmt.Errorf("invalid offset %q", args[1])
+		}
+		ctl, err := controller(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return ctl.SeekTo(ctx, *typeFlag, uint64(offset/time.Millisecond))
+
+	case "watch":
+		if err := checkArgs(cmd, args, 1); err != nil {
+			return err
+		}
+		ctl, err := controller(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		timelines, err := ctl.Subscribe(ctx, *listenFlag)
+		if err != nil {
+			return err
+		}
+		for mc := range timelines {
+			if err := printTimelines(os.Stdout, mc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func checkArgs(cmd string, args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("%s expects %d argument(s), got %d", cmd, n, len(args))
+	}
+	return nil
+}
+
+// controller creates a Controller for the player named by arg.
+func controller(ctx context.Context, arg string) (*plexible.Controller, error) {
+	id := *idFlag
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = "plexctl-" + hostname
+	}
+	if isURL(arg) {
+		return &plexible.Controller{ID: id, PlayerURL: strings.TrimSuffix(arg, "/")}, nil
+	}
+	players, err := plexible.DiscoverPlayers(ctx, *timeoutFlag)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range players {
+		if p.Name == arg || p.ResourceIdentifier == arg {
+			return plexible.NewController(id, p), nil
+		}
+	}
+	return nil, fmt.Errorf("player %q not found", arg)
+}
+
+// serverClient creates a ServerClient for the server named by arg, returning
+// it with the server's machine identifier.
+func serverClient(ctx context.Context, arg string) (*plexible.ServerClient, string, error) {
+	if isURL(arg) {
+		server := plexible.NewServerClient(strings.TrimSuffix(arg, "/"), *tokenFlag)
+		mc, err := server.Get(ctx, "/identity", nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("error identifying server %s (%s)", arg, err)
+		}
+		return server, mc.MachineIdentifier, nil
+	}
+	servers, err := plexible.DiscoverServers(ctx, *timeoutFlag)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, s := range servers {
+		if s.Name == arg || s.ResourceIdentifier == arg {
+			return s.Client(*tokenFlag), s.ResourceIdentifier, nil
+		}
+	}
+	return nil, "", fmt.Errorf("server %q not found", arg)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func printServers(w io.Writer, servers []*plexible.Server) error {
+	if *jsonFlag {
+		type server struct {
+			Name               string `json:"name"`
+			ResourceIdentifier string `json:"resourceIdentifier"`
+			URL                string `json:"url"`
+			Version            string `json:"version"`
+		}
+		out := []server{}
+		for _, s := range servers {
+			out = append(out, server{s.Name, s.ResourceIdentifier, s.BaseURL(), s.Version})
+		}
+		return printJSON(w, out)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tIDENTIFIER\tURL\tVERSION")
+	for _, s := range servers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, s.ResourceIdentifier, s.BaseURL(), s.Version)
+	}
+	return tw.Flush()
+}
+
+func printPlayers(w io.Writer, players []*plexible.RemotePlayer) error {
+	if *jsonFlag {
+		type player struct {
+			Name               string `json:"name"`
+			ResourceIdentifier string `json:"resourceIdentifier"`
+			URL                string `json:"url"`
+			Product            string `json:"product"`
+			Version            string `json:"version"`
+		}
+		out := []player{}
+		for _, p := range players {
+			out = append(out, player{p.Name, p.ResourceIdentifier, p.BaseURL(), p.Product, p.Version})
+		}
+		return printJSON(w, out)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tIDENTIFIER\tURL\tPRODUCT\tVERSION")
+	for _, p := range players {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.ResourceIdentifier, p.BaseURL(), p.Product, p.Version)
+	}
+	return tw.Flush()
+}
+
+func printResources(w io.Writer, mc *plexible.MediaContainer) error {
+	if *jsonFlag {
+		type resource struct {
+			Title             string   `json:"title"`
+			MachineIdentifier string   `json:"machineIdentifier"`
+			Product           string   `json:"product"`
+			Version           string   `json:"version"`
+			ProtocolVersion   string   `json:"protocolVersion"`
+			Capabilities      []string `json:"capabilities"`
+		}
+		out := []resource{}
+		for _, p := range mc.Players {
+			capabilities := []string{}
+			if p.ProtocolCapabilities != "" {
+				capabilities = strings.Split(p.ProtocolCapabilities, ",")
+			}
+			out = append(out, resource{p.Title, p.MachineIdentifier, p.Product,
+				p.Version, p.ProtocolVersion, capabilities})
+		}
+		return printJSON(w, out)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TITLE\tIDENTIFIER\tPRODUCT\tVERSION\tCAPABILITIES")
+	for _, p := range mc.Players {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Title, p.MachineIdentifier, p.Product, p.Version, p.ProtocolCapabilities)
+	}
+	return tw.Flush()
+}
+
+func printTimelines(w io.Writer, mc *plexible.MediaContainer) error {
+	// Each update is printed as one line of JSON.
+	if *jsonFlag {
+		type timeline struct {
+			Type              string `json:"type"`
+			State             string `json:"state"`
+			Time              uint64 `json:"time"`
+			Duration          uint64 `json:"duration"`
+			Key               string `json:"key,omitempty"`
+			RatingKey         int    `json:"ratingKey,omitempty"`
+			ContainerKey      string `json:"containerKey,omitempty"`
+			MachineIdentifier string `json:"machineIdentifier,omitempty"`
+			PlayQueueID       int    `json:"playQueueID,omitempty"`
+			PlayQueueItemID   int    `json:"playQueueItemID,omitempty"`
+			Volume            *int   `json:"volume,omitempty"`
+			Shuffle           *int   `json:"shuffle,omitempty"`
+			Repeat            *int   `json:"repeat,omitempty"`
+			AudioStreamID     int    `json:"audioStreamID,omitempty"`
+			SubtitleStreamID  int    `json:"subtitleStreamID,omitempty"`
+			VideoStreamID     int    `json:"videoStreamID,omitempty"`
+		}
+		out := []timeline{}
+		for _, t := range mc.Timelines {
+			if t.PlayerTimeline == nil {
+				continue
+			}
+			out = append(out, timeline{
+				Type:              t.Type,
+				State:             t.State,
+				Time:              t.Time,
+				Duration:          t.Duration,
+				Key:               t.Key,
+				RatingKey:         t.RatingKey,
+				ContainerKey:      t.ContainerKey,
+				MachineIdentifier: t.MachineIdentifier,
+				PlayQueueID:       t.PlayQueueID,
+				PlayQueueItemID:   t.PlayQueueItemID,
+				Volume:            t.Volume,
+				Shuffle:           t.Shuffle,
+				Repeat:            t.Repeat,
+				AudioStreamID:     t.AudioStreamID,
+				SubtitleStreamID:  t.SubtitleStreamID,
+				VideoStreamID:     t.VideoStreamID,
+			})
+		}
+		return json.NewEncoder(w).Encode(out)
+	}
+	for _, t := range mc.Timelines {
+		if t.PlayerTimeline == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s %s: %s %s/%s key=%s\n",
+			time.Now().Format("15:04:05"), t.Type, t.State,
+			millis(t.Time), millis(t.Duration), t.Key)
+	}
+	return nil
+}
+
+func millis(ms uint64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,306 @@
+package plexible
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Interval at which a subscribing Controller renews its subscription. It must
+// be less than the player's controller timeout.
+var subscriptionRenewInterval = time.Second * 30
+
+// Controller remote-controls a Plex player through its HTTP API.
+type Controller struct {
+	// Identifier of this controller, sent as X-Plex-Client-Identifier.
+	ID string
+
+	// Player API URL, e.g. http://192.168.1.3:32500
+	PlayerURL string
+
+	// Player's resource identifier, sent as X-Plex-Target-Client-Identifier.
+	PlayerID string
+
+	// HTTP client, uses http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	lock      sync.Mutex
+	commandID int
+}
+
+// NewController creates a Controller, identified by id, for a discovered
+// player.
+func NewController(id string, player *RemotePlayer) *Controller {
+	return &Controller{
+		ID:        id,
+		PlayerURL: player.BaseURL(),
+		PlayerID:  player.ResourceIdentifier,
+	}
+}
+
+// Resources returns the player's resources, i.e. its players and their
+// capabilities.
+func (c *Controller) Resources(ctx context.Context) (*MediaContainer, error) {
+	return c.get(ctx, "/resources", nil)
+}
+
+// PlayMedia tells the player to play containerKey, starting at the item with
+// the given key and offset, from server. machineIdentifier is the server's
+// identifier.
+func (c *Controller) PlayMedia(ctx context.Context, server *ServerClient,
+	machineIdentifier, containerKey, key string, offset uint64) error {
+	u, err := url.Parse(server.BaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid server url %s (%s)", server.BaseURL, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "32400"
+	}
+	params := url.Values{
+		"protocol":          {u.Scheme},
+		"address":           {u.Hostname()},
+		"port":              {port},
+		"machineIdentifier": {machineIdentifier},
+		"containerKey":      {containerKey},
+		"key":               {key},
+		"offset":            {strconv.FormatUint(offset, 10)},
+	}
+	if server.Token != "" {
+		params.Set("token", server.Token)
+	}
+	return c.command(ctx, "/player/playback/playMedia", params)
+}
+
+// Pause pauses the player of the given type.
+func (c *Controller) Pause(ctx context.Context, playerType string) error {
+	return c.command(ctx, "/player/playback/pause", url.Values{"type": {playerType}})
+}
+
+// Play resumes the player of the given type.
+func (c *Controller) Play(ctx context.Context, playerType string) error {
+	return c.command(ctx, "/player/playback/play", url.Values{"type": {playerType}})
+}
+
+// Stop stops the player of the given type.
+func (c *Controller) Stop(ctx context.Context, playerType string) error {
+	return c.command(ctx, "/player/playback/stop", url.Values{"type": {playerType}})
+}
+
+// SeekTo seeks the player of the given type to offset milliseconds.
+func (c *Controller) SeekTo(ctx context.Context, playerType string, offset uint64) error {
+	return c.command(ctx, "/player/playback/seekTo", url.Values{
+		"type":   {playerType},
+		"offset": {strconv.FormatUint(offset, 10)},
+	})
+}
+
+// SkipNext skips the player of the given type to the next item.
+func (c *Controller) SkipNext(ctx context.Context, playerType string) error {
+	return c.command(ctx, "/player/playback/skipNext", url.Values{"type": {playerType}})
+}
+
+// SkipPrevious skips the player of the given type to the previous item.
+func (c *Controller) SkipPrevious(ctx context.Context, playerType string) error {
+	return c.command(ctx, "/player/playback/skipPrevious", url.Values{"type": {playerType}})
+}
+
+// SkipTo skips the player of the given type to the item with the given key.
+func (c *Controller) SkipTo(ctx context.Context, playerType, key string) error {
+	return c.command(ctx, "/player/playback/skipTo", url.Values{
+		"type": {playerType},
+		"key":  {key},
+	})
+}
+
+// SetParameters changes the playback parameters of the player of the given
+// type. Only the non-nil parameters are sent.
+func (c *Controller) SetParameters(ctx context.Context, playerType string, cmd *SetParametersCommand) error {
+	params := url.Values{"type": {playerType}}
+	if cmd.Volume != nil {
+		params.Set("volume", strconv.Itoa(*cmd.Volume))
+	}
+	if cmd.Shuffle != nil {
+		params.Set("shuffle", strconv.Itoa(*cmd.Shuffle))
+	}
+	if cmd.Repeat != nil {
+		params.Set("repeat", strconv.Itoa(*cmd.Repeat))
+	}
+	return c.command(ctx, "/player/playback/setParameters", params)
+}
+
+// SetStreams selects the streams of the current item of the player of the
+// given type. Only the non-nil streams are sent.
+func (c *Controller) SetStreams(ctx context.Context, playerType string, cmd *SetStreamsCommand) error {
+	params := url.Values{"type": {playerType}}
+	if cmd.AudioStreamID != nil {
+		params.Set("audioStreamID", strconv.Itoa(*cmd.AudioStreamID))
+	}
+	if cmd.SubtitleStreamID != nil {
+		params.Set("subtitleStreamID", strconv.Itoa(*cmd.SubtitleStreamID))
+	}
+	if cmd.VideoStreamID != nil {
+		params.Set("videoStreamID", strconv.Itoa(*cmd.VideoStreamID))
+	}
+	return c.command(ctx, "/player/playback/setStreams", params)
+}
+
+// Poll returns the player's timelines. If wait is true the player holds the
+// request until its state changes, or for up to 30 seconds.
+func (c *Controller) Poll(ctx context.Context, wait bool) (*MediaContainer, error) {
+	params := url.Values{"commandID": {c.nextCommandID()}}
+	if wait {
+		params.Set("wait", "1")
+	}
+	return c.get(ctx, "/player/timeline/poll", params)
+}
+
+// Subscribe hosts a timeline endpoint on addr, e.g. ":0", and subscribes to
+// the player's timelines. Timelines are sent on the returned channel until ctx
+// is done, when the controller unsubscribes and the channel is closed. If the
+// receiver falls behind only the latest timeline is kept.
+func (c *Controller) Subscribe(ctx context.Context, addr string) (<-chan *MediaContainer, error) {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error creating timeline socket (%s)", err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The player posts its first timeline before the subscribe request
+	// completes, so the handler must never block.
+	timelines := make(chan *MediaContainer, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/:/timeline", func(w http.ResponseWriter, r *http.Request) {
+		mc := &MediaContainer{}
+		if err := xml.NewDecoder(r.Body).Decode(mc); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for {
+			select {
+			case timelines <- mc:
+				return
+			default:
+			}
+			// Discard the stale timeline.
+			select {
+			case <-timelines:
+			default:
+			}
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+
+	subscribe := func() error {
+		return c.command(ctx, "/player/timeline/subscribe", url.Values{
+			"protocol": {"http"},
+			"port":     {port},
+		})
+	}
+	if err := subscribe(); err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(subscriptionRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				subscribe()
+			case <-ctx.Done():
+				unsubscribeCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				c.command(unsubscribeCtx, "/player/timeline/unsubscribe", nil)
+				server.Shutdown(unsubscribeCtx)
+				cancel()
+				close(timelines)
+				return
+			}
+		}
+	}()
+
+	return timelines, nil
+}
+
+func (c *Controller) nextCommandID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.commandID++
+	return strconv.Itoa(c.commandID)
+}
+
+// command sends a command to the player, returning an error containing the
+// player's status message if it fails.
+func (c *Controller) command(ctx context.Context, path string, params url.Values) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("commandID", c.nextCommandID())
+	resp, err := c.do(ctx, path, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r := &Response{}
+		if xml.NewDecoder(resp.Body).Decode(r) == nil && r.Status != "" {
+			return fmt.Errorf("player error %d (%s)", resp.StatusCode, r.Status)
+		}
+		return fmt.Errorf("unexpected response status %s from %s", resp.Status, path)
+	}
+	return nil
+}
+
+// get requests path from the player and decodes the response.
+func (c *Controller) get(ctx context.Context, path string, params url.Values) (*MediaContainer, error) {
+	resp, err := c.do(ctx, path, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %s from %s", resp.Status, path)
+	}
+	mc := &MediaContainer{}
+	if err := xml.NewDecoder(resp.Body).Decode(mc); err != nil {
+		return nil, fmt.Errorf("error decoding xml: %s", err)
+	}
+	return mc, nil
+}
+
+func (c *Controller) do(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+
+	u := c.PlayerURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Plex-Client-Identifier", c.ID)
+	if c.PlayerID != "" {
+		req.Header.Set("X-Plex-Target-Client-Identifier", c.PlayerID)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error performing request: %s", err)
+	}
+	return resp, nil
+}
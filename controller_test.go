@@ -0,0 +1,240 @@
+package plexible
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestClient starts a Client with an acknowledging music player that
+// reports its state after each command. It returns a Controller for the
+// client.
+func startTestClient(t *testing.T) (*Client, *Controller) {
+
+	c := NewClient(&ClientInfo{ID: "test-client", Name: "test"}, nil)
+	c.APIAddr = "127.0.0.1:0"
+	c.DiscoveryAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	c.AnnounceInterval = 0
+
+	cmds := make(chan interface{})
+	timelines := make(chan *PlayerTimeline)
+	c.RegisterPlayer(TypeMusic, []string{CapabilityTimeline, CapabilityPlayback},
+		NewAckChannelPlayer(cmds), timelines)
+
+	go func() {
+		state := StateStopped
+		for cmd := range cmds {
+			switch cmd.(type) {
+			case *PauseCommand:
+				state = StatePaused
+			case *PlayCommand:
+				state = StatePlaying
+			}
+			cmd.(Acker).Ack(nil)
+			select {
+			case timelines <- &PlayerTimeline{State: state, Key: "/library/metadata/1"}:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	t.Cleanup(func() { c.Stop() })
+
+	ctl := &Controller{
+		ID:        "test-controller",
+		PlayerURL: "http://127.0.0.1:" + strconv.Itoa(c.apiPort),
+		PlayerID:  c.Info.ID,
+	}
+	return c, ctl
+}
+
+// subscribedCommandID returns the command ID the client has for the
+// controller, or "" if it isn't registered.
+func subscribedCommandID(c *Client, id string) string {
+	c.controllersLock.Lock()
+	defer c.controllersLock.Unlock()
+	for _, rc := range c.controllers {
+		if rc.controller.ClientID() == id {
+			return rc.commandID
+		}
+	}
+	return ""
+}
+
+func receiveTimeline(t *testing.T, timelines <-chan *MediaContainer) *MediaContainer {
+	select {
+	case mc, ok := <-timelines:
+		if !ok {
+			t.Fatal("timelines closed")
+		}
+		return mc
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for timeline")
+	}
+	return nil
+}
+
+func musicTimeline(t *testing.T, mc *MediaContainer) Timeline {
+	for _, tl := range mc.Timelines {
+		if tl.Type == TypeMusic && tl.PlayerTimeline != nil {
+			return tl
+		}
+	}
+	t.Fatalf("no music timeline in %+v", mc)
+	return Timeline{}
+}
+
+func TestControllerSubscribe(t *testing.T) {
+
+	defer func(d time.Duration) { subscriptionRenewInterval = d }(subscriptionRenewInterval)
+	subscriptionRenewInterval = time.Millisecond * 50
+
+	c, ctl := startTestClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timelines, err := ctl.Subscribe(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	// The client sends its timeline on subscribing.
+	mc := receiveTimeline(t, timelines)
+	if mc.MachineIdentifier != c.Info.ID {
+		t.Errorf("machineIdentifier = %q, want %q", mc.MachineIdentifier, c.Info.ID)
+	}
+	if mc.CommandID != "1" {
+		t.Errorf("commandID = %q, want 1", mc.CommandID)
+	}
+	if got := len(mc.Timelines); got != 3 {
+		t.Errorf("got %d timelines, want 3", got)
+	}
+
+	// Commands are reflected in later timelines, tagged with their command
+	// ID or a later renewal's.
+	if err := ctl.Pause(ctx, TypeMusic); err != nil {
+		t.Fatalf("Pause: %s", err)
+	}
+	for {
+		mc = receiveTimeline(t, timelines)
+		if musicTimeline(t, mc).State == StatePaused {
+			break
+		}
+	}
+	if id, _ := strconv.Atoi(mc.CommandID); id < 2 {
+		t.Errorf("commandID = %q, want at least 2", mc.CommandID)
+	}
+
+	// Renewals keep the subscription and update its command ID.
+	initial, _ := strconv.Atoi(subscribedCommandID(c, ctl.ID))
+	time.Sleep(subscriptionRenewInterval * 4)
+	renewed, _ := strconv.Atoi(subscribedCommandID(c, ctl.ID))
+	if renewed <= initial {
+		t.Errorf("commandID after renewal = %d, want more than %d", renewed, initial)
+	}
+
+	// Cancelling unsubscribes and closes the channel.
+	cancel()
+	deadline := time.After(time.Second * 5)
+	for range timelines {
+		select {
+		case <-deadline:
+			t.Fatal("timelines not closed")
+		default:
+		}
+	}
+	if id := subscribedCommandID(c, ctl.ID); id != "" {
+		t.Errorf("controller still subscribed with commandID %s", id)
+	}
+}
+
+func TestControllerPoll(t *testing.T) {
+
+	_, ctl := startTestClient(t)
+	ctx := context.Background()
+
+	mc, err := ctl.Poll(ctx, false)
+	if err != nil {
+		t.Fatalf("Poll: %s", err)
+	}
+	if mc.CommandID != "1" {
+		t.Errorf("commandID = %q, want 1", mc.CommandID)
+	}
+	if state := musicTimeline(t, mc).State; state != StateStopped {
+		t.Errorf("state = %q, want %q", state, StateStopped)
+	}
+
+	// A waiting poll returns once a command changes the player's state.
+	polled := make(chan *MediaContainer, 1)
+	errs := make(chan error, 1)
+	go func() {
+		mc, err := ctl.Poll(ctx, true)
+		if err != nil {
+			errs <- err
+			return
+		}
+		polled <- mc
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if err := ctl.Play(ctx, TypeMusic); err != nil {
+		t.Fatalf("Play: %s", err)
+	}
+	select {
+	case mc := <-polled:
+		if state := musicTimeline(t, mc).State; state != StatePlaying {
+			t.Errorf("state = %q, want %q", state, StatePlaying)
+		}
+	case err := <-errs:
+		t.Fatalf("waiting Poll: %s", err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("waiting Poll did not return")
+	}
+}
+
+func TestControllerCommandErrors(t *testing.T) {
+
+	_, ctl := startTestClient(t)
+	ctx := context.Background()
+
+	err := ctl.Pause(ctx, TypeVideo)
+	want := fmt.Sprintf("player error 404 (no player for type %s)", TypeVideo)
+	if err == nil || err.Error() != want {
+		t.Errorf("Pause(video) = %v, want %q", err, want)
+	}
+
+	if err := ctl.SeekTo(ctx, TypeMusic, 1000); err != nil {
+		t.Errorf("SeekTo: %s", err)
+	}
+}
+
+func TestClientStopsWithWaitingPoll(t *testing.T) {
+
+	c, ctl := startTestClient(t)
+
+	polled := make(chan error, 1)
+	go func() {
+		_, err := ctl.Poll(context.Background(), true)
+		polled <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	start := time.Now()
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+	if d := time.Since(start); d > time.Second*2 {
+		t.Errorf("Stop took %s with a waiting poll", d)
+	}
+	select {
+	case <-polled:
+	case <-time.After(time.Second * 2):
+		t.Error("waiting Poll did not return after Stop")
+	}
+}
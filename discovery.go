@@ -2,9 +2,12 @@ package plexible
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -26,11 +29,24 @@ var (
 
 // ClientDiscovery handles local network discovery on behalf of a client.
 //
-// The client should annouce its arrival and departure by calling Hello() and Bye(). It should also start a
+// The client should annouce its arrival and departure by calling Hello() and
+// Bye(). It should also call Serve() or ListenAndServe() to respond to
+// discovery requests, and Announce() to periodically repeat its Hello().
+//
+// Info and Port must not be changed once discovery has started, use SetName
+// and SetPort instead.
 type ClientDiscovery struct {
-	Info   *ClientInfo
-	Port   int
+	Info *ClientInfo
+	Port int
+
+	// Network interface used to join the discovery multicast group and send
+	// announcements from. The system default is used if nil.
+	Interface *net.Interface
+
 	Logger *logrus.Logger
+
+	lock    sync.Mutex
+	changed chan struct{}
 }
 
 // ListenAndServe creates a UDP connection to listen for discovery requests and
@@ -39,13 +55,22 @@ func (d *ClientDiscovery) ListenAndServe(addr *net.UDPAddr) error {
 	if addr == nil {
 		addr = &StandardClientDiscoveryAddr
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := listenDiscovery(d.Interface, addr)
 	if err != nil {
 		return fmt.Errorf("error creating client discovery socket (%s)", err)
 	}
 	return d.Serve(conn)
 }
 
+// listenDiscovery creates a UDP connection to receive discovery messages on,
+// joining the multicast group on ifi if addr is a multicast address.
+func listenDiscovery(ifi *net.Interface, addr *net.UDPAddr) (*net.UDPConn, error) {
+	if addr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp4", ifi, addr)
+	}
+	return net.ListenUDP("udp", addr)
+}
+
 // Serve loops forever to handle discovery requests on the UDP connection.
 func (d *ClientDiscovery) Serve(conn *net.UDPConn) error {
 	defer conn.Close()
@@ -55,7 +80,7 @@ func (d *ClientDiscovery) Serve(conn *net.UDPConn) error {
 		if err != nil {
 			return err
 		}
-		msg := message("HTTP/1.0 200 OK", d.Info, d.Port)
+		msg := d.message("HTTP/1.0 200 OK")
 		d.Logger.Debugf("client discovery request from %s", addr)
 		d.Logger.Debugf("sending client discovery response: %q", msg)
 		_, err = conn.WriteTo(msg, addr)
@@ -69,27 +94,106 @@ func (d *ClientDiscovery) Serve(conn *net.UDPConn) error {
 // is nil, StandardClientBroadcastAddr is used.
 func (d *ClientDiscovery) Hello(addr *net.UDPAddr) error {
 	d.Logger.Info("announcing client to network")
-	msg := message("HELLO * HTTP/1.0", d.Info, d.Port)
+	msg := d.message("HELLO * HTTP/1.0")
 	d.Logger.Debugf("sending %q", msg)
-	return send(msg, addr)
+	return send(msg, d.Interface, addr)
 }
 
 // Bye announces the client's departure to the Plex network over UDP. If addr
 // is nil, StandardClientBroadcastAddr is used.
 func (d *ClientDiscovery) Bye(addr *net.UDPAddr) error {
 	d.Logger.Info("removing client from network")
-	msg := message("BYE * HTTP/1.0", d.Info, d.Port)
+	msg := d.message("BYE * HTTP/1.0")
 	d.Logger.Debugf("sending %q", msg)
-	return send(msg, addr)
+	return send(msg, d.Interface, addr)
+}
+
+// Announce calls Hello every interval, and whenever the client's name or port
+// is changed, until ctx is done. An interval of 0 only announces changes.
+func (d *ClientDiscovery) Announce(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	changed := d.changes()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-changed:
+		}
+		if err := d.Hello(nil); err != nil {
+			d.Logger.Warnf("error re-announcing client (%s)", err)
+		}
+	}
+}
+
+// SetName changes the client's advertised name. The change is announced by
+// Announce.
+func (d *ClientDiscovery) SetName(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	info := *d.Info
+	info.Name = name
+	d.Info = &info
+	d.notifyChange()
+}
+
+// SetPort changes the client's advertised API port. The change is announced
+// by Announce.
+func (d *ClientDiscovery) SetPort(port int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.Port = port
+	d.notifyChange()
+}
+
+// changes returns a channel that receives when the name or port changes.
+func (d *ClientDiscovery) changes() <-chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{}, 1)
+	}
+	return d.changed
+}
+
+// notifyChange signals a change to Announce. The caller must hold d.lock.
+func (d *ClientDiscovery) notifyChange() {
+	if d.changed == nil {
+		d.changed = make(chan struct{}, 1)
+	}
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (d *ClientDiscovery) message(header string) []byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return message(header, d.Info, d.Port)
 }
 
-func send(msg []byte, addr *net.UDPAddr) error {
+func send(msg []byte, ifi *net.Interface, addr *net.UDPAddr) error {
 
 	if addr == nil {
 		addr = &StandardClientBroadcastAddr
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	var laddr *net.UDPAddr
+	if ifi != nil {
+		ip, err := interfaceIP(ifi)
+		if err != nil {
+			return err
+		}
+		laddr = &net.UDPAddr{IP: ip}
+	}
+
+	conn, err := net.DialUDP("udp", laddr, addr)
 	if err != nil {
 		return fmt.Errorf("error dialing %s (%s)", addr, err)
 	}
@@ -97,12 +201,26 @@ func send(msg []byte, addr *net.UDPAddr) error {
 
 	_, err = conn.Write(msg)
 	if err != nil {
-		return fmt.Errorf("error writing msg (%s)", addr, err)
+		return fmt.Errorf("error writing msg to %s (%s)", addr, err)
 	}
 
 	return nil
 }
 
+// interfaceIP returns the first IPv4 address of a network interface.
+func interfaceIP(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s addresses (%s)", ifi.Name, err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 address for %s", ifi.Name)
+}
+
 func message(header string, info *ClientInfo, port int) []byte {
 
 	params := map[string]string{
@@ -0,0 +1,150 @@
+package plexible
+
+import (
+	"context"
+	"fmt"
+)
+
+// Player is implemented by a media player registered with a Client. The
+// Client calls the method for each command it receives from a controller
+// and returns any error to the controller.
+//
+// The context is cancelled if the controller goes away before the command
+// completes.
+type Player interface {
+	PlayMedia(ctx context.Context, cmd *PlayMediaCommand) error
+	Pause(ctx context.Context) error
+	Play(ctx context.Context) error
+	Stop(ctx context.Context) error
+	Seek(ctx context.Context, offset uint64) error
+	SkipNext(ctx context.Context) error
+	SkipPrevious(ctx context.Context) error
+	SkipTo(ctx context.Context, key string) error
+	SetParameters(ctx context.Context, cmd *SetParametersCommand) error
+	SetStreams(ctx context.Context, cmd *SetStreamsCommand) error
+	RefreshPlayQueue(ctx context.Context, queue *PlayQueue) error
+}
+
+// Navigator is implemented by a Player that supports navigation commands,
+// i.e. has the navigation capability. cmd is one of the navigation command
+// types, e.g. *MoveUpCommand.
+type Navigator interface {
+	Navigate(ctx context.Context, cmd interface{}) error
+}
+
+// Mirror is implemented by a Player that supports the mirror capability.
+type Mirror interface {
+	MirrorDetails(ctx context.Context, cmd *MirrorDetailsCommand) error
+}
+
+// Acker is implemented by every command sent to a channel-based player. See
+// Reply.
+type Acker interface {
+	Ack(err error)
+}
+
+// NewChannelPlayer creates a Player that sends each command, as one of the
+// *Command types, to cmds. It also implements Navigator and Mirror.
+//
+// A command succeeds once it has been received from cmds; the player does
+// not need to Ack it.
+func NewChannelPlayer(cmds chan<- interface{}) Player {
+	return &channelPlayer{cmds: cmds}
+}
+
+// NewAckChannelPlayer creates a Player like NewChannelPlayer except each
+// command must be acknowledged by calling its Ack method. The error passed to
+// Ack is returned to the controller.
+func NewAckChannelPlayer(cmds chan<- interface{}) Player {
+	return &channelPlayer{cmds: cmds, ack: true}
+}
+
+// channelPlayer adapts a command channel to the Player interface.
+type channelPlayer struct {
+	cmds chan<- interface{}
+	ack  bool
+}
+
+// replier is implemented by commands that embed a Reply.
+type replier interface {
+	reply() *Reply
+}
+
+// send delivers cmd to the player and, if required, waits for it to be
+// acknowledged.
+func (p *channelPlayer) send(ctx context.Context, cmd replier) error {
+	reply := cmd.reply()
+	if p.ack {
+		reply.ch = make(chan error, 1)
+	}
+	select {
+	case p.cmds <- cmd:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if !p.ack {
+		return nil
+	}
+	select {
+	case err := <-reply.ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *channelPlayer) PlayMedia(ctx context.Context, cmd *PlayMediaCommand) error {
+	return p.send(ctx, cmd)
+}
+
+func (p *channelPlayer) Pause(ctx context.Context) error {
+	return p.send(ctx, &PauseCommand{})
+}
+
+func (p *channelPlayer) Play(ctx context.Context) error {
+	return p.send(ctx, &PlayCommand{})
+}
+
+func (p *channelPlayer) Stop(ctx context.Context) error {
+	return p.send(ctx, &StopCommand{})
+}
+
+func (p *channelPlayer) Seek(ctx context.Context, offset uint64) error {
+	return p.send(ctx, &SeekToCommand{Offset: offset})
+}
+
+func (p *channelPlayer) SkipNext(ctx context.Context) error {
+	return p.send(ctx, &SkipNextCommand{})
+}
+
+func (p *channelPlayer) SkipPrevious(ctx context.Context) error {
+	return p.send(ctx, &SkipPreviousCommand{})
+}
+
+func (p *channelPlayer) SkipTo(ctx context.Context, key string) error {
+	return p.send(ctx, &SkipToCommand{Key: key})
+}
+
+func (p *channelPlayer) SetParameters(ctx context.Context, cmd *SetParametersCommand) error {
+	return p.send(ctx, cmd)
+}
+
+func (p *channelPlayer) SetStreams(ctx context.Context, cmd *SetStreamsCommand) error {
+	return p.send(ctx, cmd)
+}
+
+func (p *channelPlayer) RefreshPlayQueue(ctx context.Context, queue *PlayQueue) error {
+	return p.send(ctx, &RefreshPlayQueueCommand{PlayQueue: queue})
+}
+
+func (p *channelPlayer) Navigate(ctx context.Context, cmd interface{}) error {
+	r, ok := cmd.(replier)
+	if !ok {
+		return fmt.Errorf("unsupported navigation command %T", cmd)
+	}
+	return p.send(ctx, r)
+}
+
+func (p *channelPlayer) MirrorDetails(ctx context.Context, cmd *MirrorDetailsCommand) error {
+	return p.send(ctx, cmd)
+}
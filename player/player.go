@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"os/signal"
@@ -14,6 +15,7 @@ func main() {
 
 	// Parse flags.
 	logLevelFlag := flag.String("log-level", "info", "log level (debug|info|warn|error|fatal|panic)")
+	addrFlag := flag.String("addr", plexible.DefaultAPIAddr, "client API listen address")
 	flag.Parse()
 
 	// Parse the log level.
@@ -35,26 +37,32 @@ func main() {
 		},
 		logger,
 	)
+	client.APIAddr = *addrFlag
 
 	player := NewPlayer(logger)
-	client.AddPlayer(
+	client.RegisterPlayer(
 		plexible.TypeMusic,
-		[]string{plexible.CapabilityTimeline, plexible.CapabilityPlayback},
+		[]string{plexible.CapabilityTimeline, plexible.CapabilityPlayback,
+			plexible.CapabilityPlayQueues},
+		plexible.NewAckChannelPlayer(player.cmds),
 		player.timelines,
-		player.cmds,
 	)
 	player.timelines <- &plexible.PlayerTimeline{
 		State: plexible.StateStopped,
 	}
 
-	if err := client.Start(); err != nil {
-		logger.Fatalf("error starting client: %s", err)
-	}
-	defer client.Stop()
-
-	sigs := make(chan os.Signal)
+	// Run the client until interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
-	<-sigs
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	if err := client.Run(ctx); err != nil {
+		logger.Fatalf("client error: %s", err)
+	}
 }
 
 type Player struct {
@@ -83,8 +91,10 @@ func (p *Player) cmdLoop() {
 
 	state := plexible.StateStopped
 	var containerKey string
-	var tracks []plexible.Track
+	var queue *plexible.PlayQueue
 	var playTime uint64 = 0
+	volume, shuffle, repeat := 100, 0, plexible.RepeatOff
+	var audioStreamID, subtitleStreamID, videoStreamID int
 
 	for {
 		select {
@@ -99,8 +109,12 @@ func (p *Player) cmdLoop() {
 				// Set initial play state.
 				state = plexible.StatePlaying
 				containerKey = v.ContainerKey
-				tracks = v.MediaContainer.Tracks
-				playTime = 0
+				queue = v.PlayQueue
+				playTime = v.Offset
+				audioStreamID, subtitleStreamID, videoStreamID = 0, 0, 0
+				if item := queue.Current(); item != nil && item.Media() != nil && item.Media().Part != nil {
+					p.logger.Debugf("playing %s", v.PartURL(item.Media().Part))
+				}
 				// Start ticker for time updates.
 				ticker = time.NewTicker(time.Second)
 				tickerC = ticker.C
@@ -123,17 +137,70 @@ func (p *Player) cmdLoop() {
 				// Clear play state.
 				state = plexible.StateStopped
 				containerKey = ""
-				tracks = nil
+				queue = nil
 				playTime = 0
+			case *plexible.SeekToCommand:
+				playTime = v.Offset
+			case *plexible.SkipNextCommand:
+				if queue != nil && queue.Next() != nil {
+					playTime = 0
+				}
+			case *plexible.SkipPreviousCommand:
+				if queue != nil {
+					queue.Previous()
+				}
+				playTime = 0
+			case *plexible.SetParametersCommand:
+				if v.Volume != nil {
+					volume = *v.Volume
+				}
+				if v.Shuffle != nil {
+					shuffle = *v.Shuffle
+				}
+				if v.Repeat != nil {
+					repeat = *v.Repeat
+				}
+			case *plexible.SetStreamsCommand:
+				if v.AudioStreamID != nil {
+					audioStreamID = *v.AudioStreamID
+				}
+				if v.SubtitleStreamID != nil {
+					subtitleStreamID = *v.SubtitleStreamID
+				}
+				if v.VideoStreamID != nil {
+					videoStreamID = *v.VideoStreamID
+				}
+			case *plexible.SkipToCommand:
+				if queue != nil && queue.Select(v.Key) != nil {
+					playTime = 0
+				}
+			case *plexible.RefreshPlayQueueCommand:
+				queue = v.PlayQueue
+			}
+			if a, ok := cmd.(plexible.Acker); ok {
+				a.Ack(nil)
 			}
 		}
-		t := &plexible.PlayerTimeline{State: state}
-		if tracks != nil {
-			t.Time = playTime
-			t.ContainerKey = containerKey
-			t.RatingKey = tracks[0].RatingKey
-			t.Key = tracks[0].Key
-			t.Duration = tracks[0].Duration
+		// The client holds on to the timeline, so give it its own copies.
+		v, s, r := volume, shuffle, repeat
+		t := &plexible.PlayerTimeline{
+			State:   state,
+			Volume:  &v,
+			Shuffle: &s,
+			Repeat:  &r,
+		}
+		if queue != nil {
+			if item := queue.Current(); item != nil {
+				t.Time = playTime
+				t.ContainerKey = containerKey
+				t.RatingKey = item.RatingKey()
+				t.Key = item.Key()
+				t.Duration = item.Duration()
+				t.Location = plexible.LocationFullScreenMusic
+				t.AudioStreamID = audioStreamID
+				t.SubtitleStreamID = subtitleStreamID
+				t.VideoStreamID = videoStreamID
+			}
 		}
 		p.timelines <- t
 	}
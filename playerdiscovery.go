@@ -0,0 +1,156 @@
+package plexible
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemotePlayer describes a Plex player found by DiscoverPlayers or
+// WatchPlayers.
+type RemotePlayer struct {
+	// Address the discovery message came from.
+	Addr net.Addr
+
+	Name               string
+	ResourceIdentifier string
+	Port               int
+	Product            string
+	Version            string
+	ProtocolVersion    string
+	Capabilities       []string
+
+	// All parameters in the discovery message, including those above.
+	Params map[string]string
+}
+
+// BaseURL returns the player's HTTP API URL, made from the IP address the
+// discovery message came from and the advertised port.
+func (p *RemotePlayer) BaseURL() string {
+	host := p.Addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(p.Port)))
+}
+
+// newRemotePlayer creates a RemotePlayer from the parameters of a discovery
+// message.
+func newRemotePlayer(addr net.Addr, params map[string]string) (*RemotePlayer, error) {
+	if ct := params["Content-Type"]; ct != "plex/media-player" {
+		return nil, fmt.Errorf("not a player: %q", ct)
+	}
+	p := &RemotePlayer{
+		Addr:               addr,
+		Name:               params["Name"],
+		ResourceIdentifier: params["Resource-Identifier"],
+		Product:            params["Product"],
+		Version:            params["Version"],
+		ProtocolVersion:    params["Protocol-Version"],
+		Params:             params,
+	}
+	port, err := strconv.Atoi(params["Port"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", params["Port"])
+	}
+	p.Port = port
+	if caps := params["Protocol-Capabilities"]; caps != "" {
+		p.Capabilities = strings.Split(caps, ",")
+	}
+	return p, nil
+}
+
+// DiscoverPlayers searches the local network for Plex players. It collects
+// responses until duration has passed or ctx is done, returning each player
+// once. If ctx is done first the players found so far are returned along
+// with ctx.Err().
+func DiscoverPlayers(ctx context.Context, duration time.Duration) ([]*RemotePlayer, error) {
+	players := []*RemotePlayer{}
+	seen := map[string]bool{}
+	err := search(ctx, duration, clientDiscoveryPort, func(addr net.Addr, params map[string]string) {
+		player, err := newRemotePlayer(addr, params)
+		if err != nil {
+			return
+		}
+		id := player.ResourceIdentifier
+		if id == "" {
+			id = addr.String()
+		}
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		players = append(players, player)
+	})
+	return players, err
+}
+
+// PlayerEvent types.
+const (
+	PlayerHello = "HELLO"
+	PlayerBye   = "BYE"
+)
+
+// PlayerEvent reports a player joining (PlayerHello) or leaving (PlayerBye)
+// the network.
+type PlayerEvent struct {
+	Type   string
+	Player *RemotePlayer
+}
+
+// WatchPlayers listens for players announcing their arrival and departure on
+// the network. Events are sent on the returned channel, which is closed once
+// ctx is done. Multicast membership is joined on ifi, or the system default
+// interface if nil.
+func WatchPlayers(ctx context.Context, ifi *net.Interface) (<-chan PlayerEvent, error) {
+
+	conn, err := listenDiscovery(ifi, &StandardClientBroadcastAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error creating player broadcast socket (%s)", err)
+	}
+
+	// Stop reading when the context is done.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	events := make(chan PlayerEvent)
+	go func() {
+		defer close(events)
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			header, params, err := parseMessage(b[:n])
+			if err != nil {
+				continue
+			}
+			var eventType string
+			switch header {
+			case "HELLO * HTTP/1.0":
+				eventType = PlayerHello
+			case "BYE * HTTP/1.0":
+				eventType = PlayerBye
+			default:
+				continue
+			}
+			player, err := newRemotePlayer(addr, params)
+			if err != nil {
+				continue
+			}
+			select {
+			case events <- PlayerEvent{eventType, player}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
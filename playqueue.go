@@ -0,0 +1,223 @@
+package plexible
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// PlayQueueItem is an item in a PlayQueue. Exactly one of Track, Video or
+// Photo is set.
+type PlayQueueItem struct {
+	ID    int
+	Track *Track
+	Video *Video
+	Photo *Photo
+}
+
+// Key returns the item's metadata key.
+func (i *PlayQueueItem) Key() string {
+	switch {
+	case i.Track != nil:
+		return i.Track.Key
+	case i.Video != nil:
+		return i.Video.Key
+	case i.Photo != nil:
+		return i.Photo.Key
+	}
+	return ""
+}
+
+// RatingKey returns the item's rating key.
+func (i *PlayQueueItem) RatingKey() int {
+	switch {
+	case i.Track != nil:
+		return i.Track.RatingKey
+	case i.Video != nil:
+		return i.Video.RatingKey
+	case i.Photo != nil:
+		return i.Photo.RatingKey
+	}
+	return 0
+}
+
+// Duration returns the item's duration in milliseconds.
+func (i *PlayQueueItem) Duration() uint64 {
+	switch {
+	case i.Track != nil:
+		return i.Track.Duration
+	case i.Video != nil:
+		return i.Video.Duration
+	}
+	return 0
+}
+
+// Media returns the item's media element, or nil if it has none.
+func (i *PlayQueueItem) Media() *Media {
+	switch {
+	case i.Track != nil:
+		return i.Track.Media
+	case i.Video != nil:
+		return i.Video.Media
+	case i.Photo != nil:
+		return i.Photo.Media
+	}
+	return nil
+}
+
+// PlayQueue is an ordered list of items to play and a pointer to the current
+// item. It is safe for concurrent use.
+//
+// Containers that are not server-side play queues, i.e. have no
+// playQueueID, are treated as a play queue with an ID of 0.
+type PlayQueue struct {
+	Server       *ServerClient
+	ContainerKey string
+
+	lock     sync.Mutex
+	id       int
+	version  int
+	items    []*PlayQueueItem
+	selected int
+}
+
+// NewPlayQueue creates a PlayQueue from a MediaContainer fetched from
+// containerKey on server. The current item is the container's selected item
+// or, if there is none, the item with the given key or the first item.
+func NewPlayQueue(server *ServerClient, containerKey, key string, mc *MediaContainer) *PlayQueue {
+	q := &PlayQueue{Server: server, ContainerKey: containerKey}
+	q.update(mc, key)
+	return q
+}
+
+// update replaces the queue's items with those in mc. The current item is
+// kept if it is still in the queue, otherwise the container's selected item,
+// the item with the given key or the first item is used.
+func (q *PlayQueue) update(mc *MediaContainer, key string) {
+
+	var current int
+	if q.selected >= 0 && q.selected < len(q.items) {
+		current = q.items[q.selected].ID
+	}
+
+	q.id = mc.PlayQueueID
+	q.version = mc.PlayQueueVersion
+	q.items = q.items[:0]
+	for i := range mc.Tracks {
+		q.items = append(q.items, &PlayQueueItem{ID: mc.Tracks[i].PlayQueueItemID, Track: &mc.Tracks[i]})
+	}
+	for i := range mc.Videos {
+		q.items = append(q.items, &PlayQueueItem{ID: mc.Videos[i].PlayQueueItemID, Video: &mc.Videos[i]})
+	}
+	for i := range mc.Photos {
+		q.items = append(q.items, &PlayQueueItem{ID: mc.Photos[i].PlayQueueItemID, Photo: &mc.Photos[i]})
+	}
+
+	q.selected = -1
+	for _, match := range []func(*PlayQueueItem) bool{
+		func(i *PlayQueueItem) bool { return current != 0 && i.ID == current },
+		func(i *PlayQueueItem) bool {
+			return mc.PlayQueueSelectedItemID != 0 && i.ID == mc.PlayQueueSelectedItemID
+		},
+		func(i *PlayQueueItem) bool { return key != "" && i.Key() == key },
+	} {
+		for n, i := range q.items {
+			if match(i) {
+				q.selected = n
+				break
+			}
+		}
+		if q.selected != -1 {
+			return
+		}
+	}
+	if len(q.items) > 0 {
+		q.selected = 0
+	}
+}
+
+// ID returns the server's play queue ID, or 0 if the queue is not a server
+// play queue.
+func (q *PlayQueue) ID() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.id
+}
+
+// Version returns the play queue version.
+func (q *PlayQueue) Version() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.version
+}
+
+// Items returns the items in the queue.
+func (q *PlayQueue) Items() []*PlayQueueItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]*PlayQueueItem(nil), q.items...)
+}
+
+// Current returns the current item, or nil if the queue is empty.
+func (q *PlayQueue) Current() *PlayQueueItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.selected < 0 || q.selected >= len(q.items) {
+		return nil
+	}
+	return q.items[q.selected]
+}
+
+// Next moves to and returns the next item. It returns nil, leaving the
+// current item unchanged, if the current item is the last.
+func (q *PlayQueue) Next() *PlayQueueItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.selected+1 >= len(q.items) {
+		return nil
+	}
+	q.selected++
+	return q.items[q.selected]
+}
+
+// Previous moves to and returns the previous item. It returns nil, leaving
+// the current item unchanged, if the current item is the first.
+func (q *PlayQueue) Previous() *PlayQueueItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.selected <= 0 {
+		return nil
+	}
+	q.selected--
+	return q.items[q.selected]
+}
+
+// Select moves to and returns the item with the given key. It returns nil,
+// leaving the current item unchanged, if there is no such item.
+func (q *PlayQueue) Select(key string) *PlayQueueItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for n, i := range q.items {
+		if i.Key() == key {
+			q.selected = n
+			return i
+		}
+	}
+	return nil
+}
+
+// Refresh fetches the latest version of the queue from the server. The
+// current item is kept if it is still in the queue.
+func (q *PlayQueue) Refresh(ctx context.Context) error {
+	if q.Server == nil || q.ContainerKey == "" {
+		return errors.New("play queue has no server container")
+	}
+	mc, err := q.Server.Get(ctx, q.ContainerKey, nil)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.update(mc, "")
+	return nil
+}
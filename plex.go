@@ -1,12 +1,74 @@
 package plexible
 
+import (
+	"encoding/xml"
+	"strings"
+)
+
 // MediaContainer is the top-level struct most Plex communication stanzas.
 type MediaContainer struct {
-	CommandID         string     `xml:"commandID,attr,omitempty"`
-	MachineIdentifier string     `xml:"machineIdentifier,attr,omitempty"`
-	Timelines         []Timeline `xml:"Timeline,omitempty"`
-	Players           []player   `xml:"Player,omitempty"`
-	Tracks            []Track    `xml:"Track,omitempty"`
+	CommandID                   string      `xml:"commandID,attr,omitempty"`
+	MachineIdentifier           string      `xml:"machineIdentifier,attr,omitempty"`
+	Location                    string      `xml:"location,attr,omitempty"`
+	PlayQueueID                 int         `xml:"playQueueID,attr,omitempty"`
+	PlayQueueSelectedItemID     int         `xml:"playQueueSelectedItemID,attr,omitempty"`
+	PlayQueueSelectedItemOffset int         `xml:"playQueueSelectedItemOffset,attr,omitempty"`
+	PlayQueueVersion            int         `xml:"playQueueVersion,attr,omitempty"`
+	PlayQueueTotalCount         int         `xml:"playQueueTotalCount,attr,omitempty"`
+	Size                        int         `xml:"size,attr,omitempty"`
+	TotalSize                   int         `xml:"totalSize,attr,omitempty"`
+	Title1                      string      `xml:"title1,attr,omitempty"`
+	Title2                      string      `xml:"title2,attr,omitempty"`
+	Timelines                   []Timeline  `xml:"Timeline,omitempty"`
+	Players                     []player    `xml:"Player,omitempty"`
+	Directories                 []Directory `xml:"Directory,omitempty"`
+	Hubs                        []Hub       `xml:"Hub,omitempty"`
+	Tracks                      []Track     `xml:"Track,omitempty"`
+	Videos                      []Video     `xml:"Video,omitempty"`
+	Photos                      []Photo     `xml:"Photo,omitempty"`
+}
+
+// Directory is a browsable item in a MediaContainer, e.g. a library section,
+// artist, album, show or season.
+type Directory struct {
+	RatingKey       int    `xml:"ratingKey,attr,omitempty"`
+	Key             string `xml:"key,attr,omitempty"`
+	ParentRatingKey int    `xml:"parentRatingKey,attr,omitempty"`
+	ParentKey       string `xml:"parentKey,attr,omitempty"`
+	GUID            string `xml:"guid,attr,omitempty"`
+	UUID            string `xml:"uuid,attr,omitempty"`
+	Type            string `xml:"type,attr,omitempty"`
+	Title           string `xml:"title,attr,omitempty"`
+	TitleSort       string `xml:"titleSort,attr,omitempty"`
+	ParentTitle     string `xml:"parentTitle,attr,omitempty"`
+	Summary         string `xml:"summary,attr,omitempty"`
+	Agent           string `xml:"agent,attr,omitempty"`
+	Scanner         string `xml:"scanner,attr,omitempty"`
+	Language        string `xml:"language,attr,omitempty"`
+	Index           int    `xml:"index,attr,omitempty"`
+	Year            int    `xml:"year,attr,omitempty"`
+	LeafCount       int    `xml:"leafCount,attr,omitempty"`
+	ViewedLeafCount int    `xml:"viewedLeafCount,attr,omitempty"`
+	ChildCount      int    `xml:"childCount,attr,omitempty"`
+	Thumb           string `xml:"thumb,attr,omitempty"`
+	Art             string `xml:"art,attr,omitempty"`
+	ParentThumb     string `xml:"parentThumb,attr,omitempty"`
+	AddedAt         int    `xml:"addedAt,attr,omitempty"`
+	UpdatedAt       int    `xml:"updatedAt,attr,omitempty"`
+}
+
+// Hub is a group of related items, e.g. search results of one type.
+type Hub struct {
+	HubIdentifier string      `xml:"hubIdentifier,attr,omitempty"`
+	Key           string      `xml:"key,attr,omitempty"`
+	Title         string      `xml:"title,attr,omitempty"`
+	Type          string      `xml:"type,attr,omitempty"`
+	Size          int         `xml:"size,attr,omitempty"`
+	More          int         `xml:"more,attr,omitempty"`
+	Directories   []Directory `xml:"Directory,omitempty"`
+	Tracks        []Track     `xml:"Track,omitempty"`
+	Videos        []Video     `xml:"Video,omitempty"`
+	Photos        []Photo     `xml:"Photo,omitempty"`
 }
 
 // Track is an audio track in a MediaContainer.
@@ -39,18 +101,84 @@ type Track struct {
 	Media                *Media `xml:"Media,omitempty"`
 }
 
-// Media is an audio track media element.
+// Video is a movie, episode or clip in a MediaContainer.
+type Video struct {
+	PlayQueueItemID       int    `xml:"playQueueItemID,attr,omitempty"`
+	RatingKey             int    `xml:"ratingKey,attr,omitempty"`
+	Key                   string `xml:"key,attr,omitempty"`
+	ParentRatingKey       int    `xml:"parentRatingKey,attr,omitempty"`
+	GrandparentRatingKey  int    `xml:"grandparentRatingKey,attr,omitempty"`
+	GUID                  string `xml:"guid,attr,omitempty"`
+	Type                  string `xml:"type,attr,omitempty"`
+	Title                 string `xml:"title,attr,omitempty"`
+	TitleSort             string `xml:"titleSort,attr,omitempty"`
+	GrandparentKey        string `xml:"grandparentKey,attr,omitempty"`
+	ParentKey             string `xml:"parentKey,attr,omitempty"`
+	GrandparentTitle      string `xml:"grandparentTitle,attr,omitempty"`
+	ParentTitle           string `xml:"parentTitle,attr,omitempty"`
+	OriginalTitle         string `xml:"originalTitle,attr,omitempty"`
+	ContentRating         string `xml:"contentRating,attr,omitempty"`
+	Summary               string `xml:"summary,attr,omitempty"`
+	Tagline               string `xml:"tagline,attr,omitempty"`
+	Index                 int    `xml:"index,attr,omitempty"`
+	ParentIndex           int    `xml:"parentIndex,attr,omitempty"`
+	Year                  int    `xml:"year,attr,omitempty"`
+	ViewCount             int    `xml:"viewCount,attr,omitempty"`
+	ViewOffset            uint64 `xml:"viewOffset,attr,omitempty"`
+	LastViewedAt          int    `xml:"lastViewedAt,attr,omitempty"`
+	Thumb                 string `xml:"thumb,attr,omitempty"`
+	Art                   string `xml:"art,attr,omitempty"`
+	ParentThumb           string `xml:"parentThumb,attr,omitempty"`
+	GrandparentThumb      string `xml:"grandparentThumb,attr,omitempty"`
+	GrandparentArt        string `xml:"grandparentArt,attr,omitempty"`
+	Duration              uint64 `xml:"duration,attr,omitempty"`
+	OriginallyAvailableAt string `xml:"originallyAvailableAt,attr,omitempty"`
+	AddedAt               int    `xml:"addedAt,attr,omitempty"`
+	UpdatedAt             int    `xml:"updatedAt,attr,omitempty"`
+	Media                 *Media `xml:"Media,omitempty"`
+}
+
+// Photo is a photo in a MediaContainer.
+type Photo struct {
+	PlayQueueItemID       int    `xml:"playQueueItemID,attr,omitempty"`
+	RatingKey             int    `xml:"ratingKey,attr,omitempty"`
+	Key                   string `xml:"key,attr,omitempty"`
+	ParentRatingKey       int    `xml:"parentRatingKey,attr,omitempty"`
+	GUID                  string `xml:"guid,attr,omitempty"`
+	Type                  string `xml:"type,attr,omitempty"`
+	Title                 string `xml:"title,attr,omitempty"`
+	ParentKey             string `xml:"parentKey,attr,omitempty"`
+	ParentTitle           string `xml:"parentTitle,attr,omitempty"`
+	Summary               string `xml:"summary,attr,omitempty"`
+	Index                 int    `xml:"index,attr,omitempty"`
+	Year                  int    `xml:"year,attr,omitempty"`
+	Thumb                 string `xml:"thumb,attr,omitempty"`
+	ParentThumb           string `xml:"parentThumb,attr,omitempty"`
+	OriginallyAvailableAt string `xml:"originallyAvailableAt,attr,omitempty"`
+	AddedAt               int    `xml:"addedAt,attr,omitempty"`
+	UpdatedAt             int    `xml:"updatedAt,attr,omitempty"`
+	Media                 *Media `xml:"Media,omitempty"`
+}
+
+// Media is the media element of a Track, Video or Photo.
 type Media struct {
-	ID            int    `xml:"id,attr,omitempty"`
-	Duration      uint64 `xml:"duration,attr,omitempty"`
-	Bitrate       int    `xml:"bitrate,attr,omitempty"`
-	AudioChannels int    `xml:"audioChannels,attr,omitempty"`
-	AudioCodec    string `xml:"audioCodec,attr,omitempty"`
-	Container     string `xml:"container,attr,omitempty"`
-	Part          *Part  `xml:"Part,omitempty"`
+	ID              int     `xml:"id,attr,omitempty"`
+	Duration        uint64  `xml:"duration,attr,omitempty"`
+	Bitrate         int     `xml:"bitrate,attr,omitempty"`
+	Width           int     `xml:"width,attr,omitempty"`
+	Height          int     `xml:"height,attr,omitempty"`
+	AspectRatio     float64 `xml:"aspectRatio,attr,omitempty"`
+	AudioChannels   int     `xml:"audioChannels,attr,omitempty"`
+	AudioCodec      string  `xml:"audioCodec,attr,omitempty"`
+	VideoCodec      string  `xml:"videoCodec,attr,omitempty"`
+	VideoResolution string  `xml:"videoResolution,attr,omitempty"`
+	VideoFrameRate  string  `xml:"videoFrameRate,attr,omitempty"`
+	VideoProfile    string  `xml:"videoProfile,attr,omitempty"`
+	Container       string  `xml:"container,attr,omitempty"`
+	Part            *Part   `xml:"Part,omitempty"`
 }
 
-// Part is an audo track media part.
+// Part is a media part.
 type Part struct {
 	ID        int      `xml:"id,attr,omitempty"`
 	Key       string   `xml:"key,attr,omitempty"`
@@ -61,18 +189,50 @@ type Part struct {
 	Streams   []Stream `xml:"Stream,omitempty"`
 }
 
-// Stream is an audio track media stream.
+// Stream is a media part's video, audio or subtitle stream.
 type Stream struct {
-	ID           int    `xml:"id,attr,omitempty"`
-	StreamType   int    `xml:"streamType,attr,omitempty"`
-	Selected     int    `xml:"selected,attr,omitempty"`
-	Codec        string `xml:"codec,attr,omitempty"`
-	Index        int    `xml:"index,attr,omitempty"`
-	Channels     int    `xml:"channels,attr,omitempty"`
-	Bitrate      int    `xml:"bitrate,attr,omitempty"`
-	BitrateMode  string `xml:"bitrateMode,attr,omitempty"`
-	Duration     uint64 `xml:"duration,attr,omitempty"`
-	SamplingRate int    `xml:"samplingRate,attr,omitempty"`
+	ID           int     `xml:"id,attr,omitempty"`
+	StreamType   int     `xml:"streamType,attr,omitempty"`
+	Selected     int     `xml:"selected,attr,omitempty"`
+	Codec        string  `xml:"codec,attr,omitempty"`
+	Index        int     `xml:"index,attr,omitempty"`
+	Channels     int     `xml:"channels,attr,omitempty"`
+	Bitrate      int     `xml:"bitrate,attr,omitempty"`
+	BitrateMode  string  `xml:"bitrateMode,attr,omitempty"`
+	Duration     uint64  `xml:"duration,attr,omitempty"`
+	SamplingRate int     `xml:"samplingRate,attr,omitempty"`
+	Width        int     `xml:"width,attr,omitempty"`
+	Height       int     `xml:"height,attr,omitempty"`
+	FrameRate    float64 `xml:"frameRate,attr,omitempty"`
+	Profile      string  `xml:"profile,attr,omitempty"`
+	Level        int     `xml:"level,attr,omitempty"`
+	BitDepth     int     `xml:"bitDepth,attr,omitempty"`
+	ScanType     string  `xml:"scanType,attr,omitempty"`
+	Format       string  `xml:"format,attr,omitempty"`
+	Language     string  `xml:"language,attr,omitempty"`
+	LanguageCode string  `xml:"languageCode,attr,omitempty"`
+	Title        string  `xml:"title,attr,omitempty"`
+	DisplayTitle string  `xml:"displayTitle,attr,omitempty"`
+	Forced       int     `xml:"forced,attr,omitempty"`
+	Default      int     `xml:"default,attr,omitempty"`
+
+	// Key of a sidecar subtitle file, relative to the server.
+	Key string `xml:"key,attr,omitempty"`
+}
+
+// Stream types.
+const (
+	StreamTypeVideo    = 1
+	StreamTypeAudio    = 2
+	StreamTypeSubtitle = 3
+)
+
+// Response is the body returned by the client API to report the outcome of a
+// command.
+type Response struct {
+	XMLName xml.Name `xml:"Response"`
+	Code    int      `xml:"code,attr"`
+	Status  string   `xml:"status,attr"`
 }
 
 // Player capabilities.
@@ -84,24 +244,103 @@ const (
 	CapabilityPlayQueues = "playqueues"
 )
 
+// Player controls, reported in a timeline's controllable attribute.
+const (
+	ControlPlayPause    = "playPause"
+	ControlStop         = "stop"
+	ControlSeekTo       = "seekTo"
+	ControlSkipPrevious = "skipPrevious"
+	ControlSkipNext     = "skipNext"
+	ControlVolume       = "volume"
+	ControlShuffle      = "shuffle"
+	ControlRepeat       = "repeat"
+)
+
+// Repeat modes.
+const (
+	RepeatOff = 0
+	RepeatOne = 1
+	RepeatAll = 2
+)
+
+// Controls is a list of player controls. It is encoded as a comma-separated
+// XML attribute.
+type Controls []string
+
+// MarshalXMLAttr implements xml.MarshalerAttr.
+func (c Controls) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	if len(c) == 0 {
+		return xml.Attr{}, nil
+	}
+	return xml.Attr{Name: name, Value: strings.Join(c, ",")}, nil
+}
+
+// UnmarshalXMLAttr implements xml.UnmarshalerAttr.
+func (c *Controls) UnmarshalXMLAttr(attr xml.Attr) error {
+	if attr.Value == "" {
+		*c = nil
+		return nil
+	}
+	*c = strings.Split(attr.Value, ",")
+	return nil
+}
+
 // PlayerTimeline repesents the state of a Player. It does not include the
 // fields that are better for the Client to add.
+//
+// Volume, Mute, Shuffle and Repeat are optional and should only be set by
+// players that support changing them. If Controllable is nil the Client
+// derives it from the player's capabilities and the optional fields that are
+// set.
+//
+// AudioStreamID, SubtitleStreamID and VideoStreamID are the IDs of the
+// selected streams of the current item, if any.
 type PlayerTimeline struct {
-	State        string `xml:"state,attr,omitempty"`
-	Duration     uint64 `xml:"duration,attr,omitempty"`
-	Time         uint64 `xml:"time,attr,omitempty"`
-	RatingKey    int    `xml:"ratingKey,attr,omitempty"`
-	Key          string `xml:"key,attr,omitempty"`
-	ContainerKey string `xml:"containerKey,attr,omitempty"`
+	State            string   `xml:"state,attr,omitempty"`
+	Duration         uint64   `xml:"duration,attr,omitempty"`
+	Time             uint64   `xml:"time,attr,omitempty"`
+	RatingKey        int      `xml:"ratingKey,attr,omitempty"`
+	Key              string   `xml:"key,attr,omitempty"`
+	ContainerKey     string   `xml:"containerKey,attr,omitempty"`
+	Volume           *int     `xml:"volume,attr,omitempty"`
+	Mute             *int     `xml:"mute,attr,omitempty"`
+	Shuffle          *int     `xml:"shuffle,attr,omitempty"`
+	Repeat           *int     `xml:"repeat,attr,omitempty"`
+	AudioStreamID    int      `xml:"audioStreamID,attr,omitempty"`
+	SubtitleStreamID int      `xml:"subtitleStreamID,attr,omitempty"`
+	VideoStreamID    int      `xml:"videoStreamID,attr,omitempty"`
+	Controllable     Controls `xml:"controllable,attr,omitempty"`
+	Location         string   `xml:"location,attr,omitempty"`
 }
 
 // Timeline repesents the current state of a Player, including attributes
 // better handled by the Client.
+//
+// The server attributes, MachineIdentifier to Token, describe the server of
+// the last PlayMediaCommand sent to the player and are only set while it is
+// not stopped.
 type Timeline struct {
 	*PlayerTimeline
-	Type string `xml:"type,attr,omitempty"`
+	Type              string `xml:"type,attr,omitempty"`
+	MachineIdentifier string `xml:"machineIdentifier,attr,omitempty"`
+	Address           string `xml:"address,attr,omitempty"`
+	Port              string `xml:"port,attr,omitempty"`
+	Protocol          string `xml:"protocol,attr,omitempty"`
+	Token             string `xml:"token,attr,omitempty"`
+	SeekRange         string `xml:"seekRange,attr,omitempty"`
+	PlayQueueID       int    `xml:"playQueueID,attr,omitempty"`
+	PlayQueueItemID   int    `xml:"playQueueItemID,attr,omitempty"`
+	PlayQueueVersion  int    `xml:"playQueueVersion,attr,omitempty"`
 }
 
+// Player locations, i.e. what the player is currently showing.
+const (
+	LocationNavigation      = "navigation"
+	LocationFullScreenVideo = "fullScreenVideo"
+	LocationFullScreenMusic = "fullScreenMusic"
+	LocationFullScreenPhoto = "fullScreenPhoto"
+)
+
 // Player types.
 const (
 	TypeMusic = "music"
@@ -136,22 +375,205 @@ type player struct {
 }
 
 // PlayMediaCommand is sent to a player to start playback of new media.
+//
+// PlayQueue is created from MediaContainer and is shared with the Client. The
+// player should move through it as it plays so the Client can report the
+// current item.
+//
+// Token is the media server's access token, and must be included in requests
+// to the server. Use PartURL to build a part's stream URL.
 type PlayMediaCommand struct {
-	ServerURL      string
-	MediaContainer *MediaContainer
-	ContainerKey   string
-	Key            string
-	Offset         uint64
+	Reply
+
+	ServerURL         string
+	Token             string
+	MachineIdentifier string
+	MediaContainer    *MediaContainer
+	PlayQueue         *PlayQueue
+	ContainerKey      string
+	Key               string
+	Offset            uint64
+}
+
+// PartURL returns the authenticated URL of a media part's stream.
+func (c *PlayMediaCommand) PartURL(part *Part) string {
+	return NewServerClient(c.ServerURL, c.Token).URL(part.Key)
+}
+
+// MirrorDetailsCommand is sent to a player to show the details of an item
+// being browsed on a controller, without starting playback.
+type MirrorDetailsCommand struct {
+	Reply
+
+	ServerURL         string
+	Token             string
+	MachineIdentifier string
+	Key               string
+	MediaContainer    *MediaContainer
+}
+
+// RefreshPlayQueueCommand is sent to a player after its PlayQueue has been
+// refreshed from the server.
+type RefreshPlayQueueCommand struct {
+	Reply
+
+	PlayQueue *PlayQueue
 }
 
 // PauseCommand is sent to a player to pause playback.
 type PauseCommand struct {
+	Reply
 }
 
 // PlayCommand is sent to a player to resume playback.
 type PlayCommand struct {
+	Reply
 }
 
 // StopCommand is sent to a player to stop playback.
 type StopCommand struct {
+	Reply
+}
+
+// SeekToCommand is sent to a player to seek to an offset (in milliseconds)
+// within the current media.
+type SeekToCommand struct {
+	Reply
+
+	Offset uint64
+}
+
+// SkipNextCommand is sent to a player to skip to the next item.
+type SkipNextCommand struct {
+	Reply
+}
+
+// SkipPreviousCommand is sent to a player to skip to the previous item.
+type SkipPreviousCommand struct {
+	Reply
+}
+
+// SkipToCommand is sent to a player to skip to the item with the given key.
+type SkipToCommand struct {
+	Reply
+
+	Key string
+}
+
+// SetParametersCommand is sent to a player to change playback parameters.
+// Only the parameters included in the request are set, the rest are nil.
+// Shuffle is 0 or 1, Repeat is one of the Repeat* modes.
+type SetParametersCommand struct {
+	Reply
+
+	Volume  *int
+	Shuffle *int
+	Repeat  *int
+}
+
+// SetStreamsCommand is sent to a player to select the streams of the current
+// item. Only the streams included in the request are set, the rest are nil. A
+// SubtitleStreamID of 0 turns subtitles off.
+type SetStreamsCommand struct {
+	Reply
+
+	AudioStreamID    *int
+	SubtitleStreamID *int
+	VideoStreamID    *int
+}
+
+// MoveUpCommand is sent to a navigation player to move the selection up.
+type MoveUpCommand struct {
+	Reply
+}
+
+// MoveDownCommand is sent to a navigation player to move the selection down.
+type MoveDownCommand struct {
+	Reply
+}
+
+// MoveLeftCommand is sent to a navigation player to move the selection left.
+type MoveLeftCommand struct {
+	Reply
+}
+
+// MoveRightCommand is sent to a navigation player to move the selection right.
+type MoveRightCommand struct {
+	Reply
+}
+
+// SelectCommand is sent to a navigation player to select the current item.
+type SelectCommand struct {
+	Reply
+}
+
+// BackCommand is sent to a navigation player to go back.
+type BackCommand struct {
+	Reply
+}
+
+// HomeCommand is sent to a navigation player to go to the home screen.
+type HomeCommand struct {
+	Reply
+}
+
+// MusicCommand is sent to a navigation player to show the music player.
+type MusicCommand struct {
+	Reply
+}
+
+// ContextMenuCommand is sent to a navigation player to show the context menu.
+type ContextMenuCommand struct {
+	Reply
+}
+
+// ToggleOSDCommand is sent to a navigation player to show or hide the
+// on-screen display.
+type ToggleOSDCommand struct {
+	Reply
+}
+
+// PageUpCommand is sent to a navigation player to move up a page.
+type PageUpCommand struct {
+	Reply
+}
+
+// PageDownCommand is sent to a navigation player to move down a page.
+type PageDownCommand struct {
+	Reply
+}
+
+// NextLetterCommand is sent to a navigation player to jump to the next
+// letter.
+type NextLetterCommand struct {
+	Reply
+}
+
+// PreviousLetterCommand is sent to a navigation player to jump to the
+// previous letter.
+type PreviousLetterCommand struct {
+	Reply
+}
+
+// Reply is embedded in each command sent to a channel-based player. A player
+// registered with NewAckChannelPlayer must call Ack once it has handled the
+// command. Ack does nothing for other players.
+type Reply struct {
+	ch chan error
+}
+
+// Ack reports the outcome of the command to the Client. err is nil if the
+// command succeeded.
+func (r *Reply) Ack(err error) {
+	if r.ch == nil {
+		return
+	}
+	select {
+	case r.ch <- err:
+	default:
+	}
+}
+
+func (r *Reply) reply() *Reply {
+	return r
 }
@@ -0,0 +1,93 @@
+package plexible
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Minimum time between progress reports to a media server while a player's
+// state and item are unchanged.
+const serverReportInterval = time.Second * 10
+
+// Timeout for a single request to a media server.
+const serverReportTimeout = time.Second * 10
+
+// Fraction of an item that must be played before it is scrobbled.
+const scrobbleThreshold = 0.9
+
+// serverReporter reports a player's progress to the media server the player's
+// media came from.
+type serverReporter struct {
+	server *ServerClient
+	logger *logrus.Logger
+
+	// Last report.
+	state     string
+	ratingKey int
+	key       string
+	reported  time.Time
+	scrobbled bool
+}
+
+func newServerReporter(server *ServerClient, logger *logrus.Logger) *serverReporter {
+	return &serverReporter{server: server, logger: logger}
+}
+
+// Report sends the timeline to the server if the state or item has changed
+// or serverReportInterval has passed since the last report, and scrobbles the
+// item once it passes scrobbleThreshold. Requests are cancelled if ctx is
+// done.
+func (r *serverReporter) Report(ctx context.Context, t *PlayerTimeline) {
+
+	// A stopped player often forgets its item, report the stop against the
+	// last item instead.
+	ratingKey, key := t.RatingKey, t.Key
+	if t.State == StateStopped && key == "" {
+		ratingKey, key = r.ratingKey, r.key
+	}
+	if key == "" {
+		return
+	}
+
+	changed := t.State != r.state || key != r.key
+	if key != r.key {
+		r.scrobbled = false
+	}
+	r.state, r.ratingKey, r.key = t.State, ratingKey, key
+
+	if changed || time.Since(r.reported) >= serverReportInterval {
+		r.reported = time.Now()
+		params := url.Values{
+			"state":     {t.State},
+			"time":      {strconv.FormatUint(t.Time, 10)},
+			"duration":  {strconv.FormatUint(t.Duration, 10)},
+			"ratingKey": {strconv.Itoa(ratingKey)},
+			"key":       {key},
+		}
+		if t.ContainerKey != "" {
+			params.Set("containerKey", t.ContainerKey)
+		}
+		ctx, cancel := context.WithTimeout(ctx, serverReportTimeout)
+		err := r.server.Timeline(ctx, params)
+		cancel()
+		if err != nil {
+			r.logger.Errorf("error reporting timeline to %s: %s", r.server.BaseURL, err)
+		}
+	}
+
+	if !r.scrobbled && t.Duration > 0 &&
+		float64(t.Time) >= float64(t.Duration)*scrobbleThreshold {
+		r.scrobbled = true
+		r.logger.Debugf("scrobbling %s", key)
+		ctx, cancel := context.WithTimeout(ctx, serverReportTimeout)
+		err := r.server.Scrobble(ctx, ratingKey)
+		cancel()
+		if err != nil {
+			r.logger.Errorf("error scrobbling %s to %s: %s", key, r.server.BaseURL, err)
+		}
+	}
+}
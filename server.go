@@ -3,73 +3,171 @@ package plexible
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Server describes a Plex Media Server found by DiscoverServers.
 type Server struct {
-	Addr   net.Addr
+	// Address the discovery response came from.
+	Addr net.Addr
+
+	Name               string
+	Port               int
+	ResourceIdentifier string
+	Version            string
+	UpdatedAt          time.Time
+	ContentType        string
+
+	// All parameters in the discovery response, including those above.
 	Params map[string]string
 }
 
-func DiscoverServers(duration time.Duration) ([]*Server, error) {
+// BaseURL returns the server's HTTP URL, made from the responding IP address
+// and the advertised port.
+func (s *Server) BaseURL() string {
+	host := s.Addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(s.Port)))
+}
+
+// newServer creates a Server from the parameters of a discovery response.
+func newServer(addr net.Addr, params map[string]string) (*Server, error) {
+	s := &Server{
+		Addr:               addr,
+		Name:               params["Name"],
+		ResourceIdentifier: params["Resource-Identifier"],
+		Version:            params["Version"],
+		ContentType:        params["Content-Type"],
+		Params:             params,
+	}
+	port, err := strconv.Atoi(params["Port"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", params["Port"])
+	}
+	s.Port = port
+	if v, ok := params["Updated-At"]; ok {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid updated-at %q", v)
+		}
+		s.UpdatedAt = time.Unix(secs, 0)
+	}
+	return s, nil
+}
+
+// DiscoverServers searches the local network for Plex Media Servers. It
+// collects responses until duration has passed or ctx is done, returning each
+// server once. If ctx is done first the servers found so far are returned
+// along with ctx.Err().
+func DiscoverServers(ctx context.Context, duration time.Duration) ([]*Server, error) {
+	servers := []*Server{}
+	seen := map[string]bool{}
+	err := search(ctx, duration, serverDiscoveryPort, func(addr net.Addr, params map[string]string) {
+		server, err := newServer(addr, params)
+		if err != nil {
+			return
+		}
+		id := server.ResourceIdentifier
+		if id == "" {
+			id = addr.String()
+		}
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		servers = append(servers, server)
+	})
+	return servers, err
+}
+
+// search sends a discovery request to port and calls handle with the
+// parameters of each response until duration has passed or ctx is done. If
+// ctx is done first ctx.Err() is returned.
+func search(ctx context.Context, duration time.Duration, port int,
+	handle func(addr net.Addr, params map[string]string)) error {
 
 	// Create UDP socket with OS-assigned port.
 	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer conn.Close()
 
-	// Broadcast discovery message to Plex server port.
-	conn.WriteTo(
+	// Broadcast discovery message to the port.
+	_, err = conn.WriteTo(
 		[]byte("M-SEARCH * HTTP/1.0"),
-		&net.UDPAddr{IP: net.ParseIP(discoveryIP), Port: serverDiscoveryPort},
+		&net.UDPAddr{IP: net.ParseIP(discoveryIP), Port: port},
 	)
+	if err != nil {
+		return fmt.Errorf("error sending discovery request (%s)", err)
+	}
 
-	// Start goroutine to listen for server responses.
-	ch := make(chan *Server)
+	// Read until the timeout, or earlier if the context is done.
+	deadline := time.Now().Add(duration)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		b := make([]byte, 1024)
-		n, addr, err := conn.ReadFrom(b)
-		if err != nil {
-			return
-		}
-		params, err := parseServerResponse(b[:n])
-		if err != nil {
-			return
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
 		}
-		ch <- &Server{addr, params}
 	}()
 
-	// Collect servers until the timeout.
-	servers := []*Server{}
-	timeout := time.After(duration)
-Collection:
+	b := make([]byte, 1024)
 	for {
-		select {
-		case s := <-ch:
-			servers = append(servers, s)
-		case <-timeout:
-			break Collection
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return err
+		}
+		params, err := parseResponse(b[:n])
+		if err != nil {
+			continue
 		}
+		handle(addr, params)
 	}
 
-	return servers, nil
+	return ctx.Err()
 }
 
-func parseServerResponse(b []byte) (map[string]string, error) {
+// parseResponse parses a discovery response.
+func parseResponse(b []byte) (map[string]string, error) {
+	header, params, err := parseMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	if header != "HTTP/1.0 200 OK" {
+		return nil, fmt.Errorf("Unrecognised response header: %s", header)
+	}
+	return params, nil
+}
+
+// parseMessage parses a discovery message into its header line and
+// parameters.
+func parseMessage(b []byte) (string, map[string]string, error) {
+	var header string
 	params := map[string]string{}
 	s := bufio.NewScanner(bytes.NewReader(b))
 	first := true
 	for s.Scan() {
 		line := s.Text()
 		if first {
-			if line != "HTTP/1.0 200 OK" {
-				return nil, fmt.Errorf("Unrecognised response header: %s", line)
-			}
+			header = line
 			first = false
 			continue
 		}
@@ -77,7 +175,13 @@ func parseServerResponse(b []byte) (map[string]string, error) {
 			break
 		}
 		parts := strings.SplitN(line, ":", 2)
-		params[parts[0]] = strings.TrimSpace(parts[1])
+		if len(parts) != 2 || parts[0] == "" {
+			return "", nil, fmt.Errorf("Malformed message line: %s", line)
+		}
+		params[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 	}
-	return params, nil
+	if first {
+		return "", nil, errors.New("Empty message")
+	}
+	return header, params, s.Err()
 }
@@ -0,0 +1,183 @@
+package plexible
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ServerClient makes requests to a Plex Media Server's HTTP API.
+type ServerClient struct {
+	// Server URL, e.g. http://192.168.1.2:32400
+	BaseURL string
+
+	// Access token, sent as X-Plex-Token. May be empty for servers that do
+	// not require authentication.
+	Token string
+
+	// Identifier of the client making requests, sent as
+	// X-Plex-Client-Identifier if set.
+	ClientIdentifier string
+
+	// HTTP client, uses http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// NewServerClient creates a ServerClient for the server at baseURL.
+func NewServerClient(baseURL, token string) *ServerClient {
+	return &ServerClient{BaseURL: baseURL, Token: token}
+}
+
+// Client creates a ServerClient for a discovered server.
+func (s *Server) Client(token string) *ServerClient {
+	return NewServerClient(s.BaseURL(), token)
+}
+
+// URL returns the server URL of path, e.g. a Part's Key, including the access
+// token so it can be used where headers can't be set, e.g. in a media player.
+func (c *ServerClient) URL(path string) string {
+	if c.Token == "" {
+		return c.BaseURL + path
+	}
+	return c.BaseURL + withQuery(path, url.Values{"X-Plex-Token": {c.Token}})
+}
+
+// withQuery adds params to path, which may already have a query.
+func withQuery(path string, params url.Values) string {
+	if len(params) == 0 {
+		return path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + params.Encode()
+}
+
+// Sections returns the server's library sections as Directories.
+func (c *ServerClient) Sections(ctx context.Context) (*MediaContainer, error) {
+	return c.Get(ctx, "/library/sections", nil)
+}
+
+// Metadata returns the item with the given rating key.
+func (c *ServerClient) Metadata(ctx context.Context, ratingKey int) (*MediaContainer, error) {
+	return c.Get(ctx, "/library/metadata/"+strconv.Itoa(ratingKey), nil)
+}
+
+// Children returns the children of the item with the given rating key, e.g.
+// an album's tracks or a show's seasons.
+func (c *ServerClient) Children(ctx context.Context, ratingKey int) (*MediaContainer, error) {
+	return c.Get(ctx, "/library/metadata/"+strconv.Itoa(ratingKey)+"/children", nil)
+}
+
+// Search searches the server's libraries. Results are grouped into Hubs by
+// type. If limit is greater than zero it limits the number of results in
+// each hub.
+func (c *ServerClient) Search(ctx context.Context, query string, limit int) (*MediaContainer, error) {
+	params := url.Values{"query": {query}}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	return c.Get(ctx, "/hubs/search", params)
+}
+
+// OnDeck returns the items that are on deck, i.e. partially watched or next
+// in a series.
+func (c *ServerClient) OnDeck(ctx context.Context) (*MediaContainer, error) {
+	return c.Get(ctx, "/library/onDeck", nil)
+}
+
+// Timeline reports a player's state to the server so it can track playback
+// progress. params should include state, time, duration, ratingKey and key.
+func (c *ServerClient) Timeline(ctx context.Context, params url.Values) error {
+	resp, err := c.do(ctx, "POST", "/:/timeline", params)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Scrobble marks the item with the given rating key as watched.
+func (c *ServerClient) Scrobble(ctx context.Context, ratingKey int) error {
+	params := url.Values{
+		"key":        {strconv.Itoa(ratingKey)},
+		"identifier": {"com.plexapp.plugins.library"},
+	}
+	resp, err := c.do(ctx, "GET", "/:/scrobble", params)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SetStreams records the audio and subtitle streams selected for a media
+// part so they are used next time it is played. Only the non-nil streams are
+// changed, a subtitleStreamID of 0 turns subtitles off.
+func (c *ServerClient) SetStreams(ctx context.Context, partID int, audioStreamID, subtitleStreamID *int) error {
+	params := url.Values{}
+	if audioStreamID != nil {
+		params.Set("audioStreamID", strconv.Itoa(*audioStreamID))
+	}
+	if subtitleStreamID != nil {
+		params.Set("subtitleStreamID", strconv.Itoa(*subtitleStreamID))
+	}
+	resp, err := c.do(ctx, "PUT", fmt.Sprintf("/library/parts/%d", partID), params)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get requests path, with optional query parameters, and decodes the
+// response.
+func (c *ServerClient) Get(ctx context.Context, path string, params url.Values) (*MediaContainer, error) {
+	resp, err := c.do(ctx, "GET", path, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	mc := &MediaContainer{}
+	if err := xml.NewDecoder(resp.Body).Decode(mc); err != nil {
+		return nil, fmt.Errorf("error decoding xml: %s", err)
+	}
+	return mc, nil
+}
+
+// do performs a request and checks the response status. The caller must
+// close the response body.
+func (c *ServerClient) do(ctx context.Context, method, path string, params url.Values) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, c.BaseURL+withQuery(path, params), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/xml")
+	if c.Token != "" {
+		req.Header.Set("X-Plex-Token", c.Token)
+	}
+	if c.ClientIdentifier != "" {
+		req.Header.Set("X-Plex-Client-Identifier", c.ClientIdentifier)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error performing request: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response status %s from %s", resp.Status, path)
+	}
+	return resp, nil
+}
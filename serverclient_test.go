@@ -0,0 +1,68 @@
+package plexible
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerClientSetStreams(t *testing.T) {
+
+	audio, subtitles := 12, 0
+
+	tests := []struct {
+		name             string
+		audioStreamID    *int
+		subtitleStreamID *int
+		query            string
+	}{
+		{"both", &audio, &subtitles, "audioStreamID=12&subtitleStreamID=0"},
+		{"audio", &audio, nil, "audioStreamID=12"},
+		{"subtitles", nil, &subtitles, "subtitleStreamID=0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var method, path, query, token string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, path, query = r.Method, r.URL.Path, r.URL.RawQuery
+				token = r.Header.Get("X-Plex-Token")
+			}))
+			defer server.Close()
+
+			c := NewServerClient(server.URL, "secret")
+			err := c.SetStreams(context.Background(), 42, test.audioStreamID, test.subtitleStreamID)
+			if err != nil {
+				t.Fatalf("SetStreams: %s", err)
+			}
+
+			if method != "PUT" {
+				t.Errorf("method = %q, want PUT", method)
+			}
+			if path != "/library/parts/42" {
+				t.Errorf("path = %q, want /library/parts/42", path)
+			}
+			if query != test.query {
+				t.Errorf("query = %q, want %q", query, test.query)
+			}
+			if token != "secret" {
+				t.Errorf("X-Plex-Token = %q, want secret", token)
+			}
+		})
+	}
+}
+
+func TestServerClientSetStreamsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	audio := 1
+	c := NewServerClient(server.URL, "")
+	if err := c.SetStreams(context.Background(), 42, &audio, nil); err == nil {
+		t.Error("SetStreams succeeded, want error for 401 response")
+	}
+}
@@ -0,0 +1,204 @@
+package plexible
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DecodeProfile describes the containers and codecs a player can decode.
+// Names are as reported by the server, e.g. "mp3", "flac", "mp4", "h264".
+type DecodeProfile struct {
+	Containers  []string
+	AudioCodecs []string
+	VideoCodecs []string
+}
+
+// CanDirectPlay returns true if the player can decode the media as it is,
+// i.e. its container and codecs are all in the profile. Attributes the server
+// did not report are ignored.
+func (p *DecodeProfile) CanDirectPlay(m *Media) bool {
+	container := m.Container
+	if container == "" && m.Part != nil {
+		container = m.Part.Container
+	}
+	return supported(p.Containers, container) &&
+		supported(p.AudioCodecs, m.AudioCodec) &&
+		supported(p.VideoCodecs, m.VideoCodec)
+}
+
+// supported returns true if name is empty or one of names.
+func supported(names []string, name string) bool {
+	if name == "" {
+		return true
+	}
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Containers and codecs the universal transcoder can produce, by media type.
+var (
+	musicTranscodeContainers  = []string{"mp3", "mp4", "mkv", "mpegts"}
+	musicTranscodeAudioCodecs = []string{"mp3", "aac", "opus", "flac"}
+	videoTranscodeContainers  = []string{"mpegts", "mp4", "mkv"}
+	videoTranscodeVideoCodecs = []string{"h264", "hevc"}
+	videoTranscodeAudioCodecs = []string{"aac", "mp3", "ac3", "opus"}
+)
+
+// transcodeTarget returns the first of the profile's names the transcoder can
+// produce, so profiles should list names in order of preference.
+func transcodeTarget(kind string, names, producible []string) (string, error) {
+	for _, n := range names {
+		n = strings.ToLower(n)
+		if n != "" && supported(producible, n) {
+			return n, nil
+		}
+	}
+	return "", fmt.Errorf("no transcodable %s in profile %v", kind, names)
+}
+
+// TranscodeOptions configures a transcode URL. Zero values use the defaults
+// noted.
+type TranscodeOptions struct {
+	// Transcode session ID, required. A player must use the same session for
+	// every request of a stream so the server can reuse the transcoder. See
+	// NewTranscodeSession.
+	Session string
+
+	// Maximum bitrate in kbps. Defaults to 320 for music and 4000 for video.
+	MaxBitrate int
+
+	// Offset to start at, in milliseconds.
+	Offset uint64
+
+	// Streaming protocol. Defaults to "http" for music and "hls" for video.
+	Protocol string
+}
+
+// NewTranscodeSession returns a new random transcode session ID.
+func NewTranscodeSession() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating transcode session (%s)", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// MusicTranscodeURL returns the URL of a stream of track transcoded by the
+// server's universal transcoder, for players that cannot direct play it. The
+// stream uses the first container and audio codec in profile the transcoder
+// can produce.
+func (c *ServerClient) MusicTranscodeURL(track *Track, profile *DecodeProfile, opts *TranscodeOptions) (string, error) {
+	if profile == nil || opts == nil {
+		return "", errors.New("missing decode profile or transcode options")
+	}
+	o := *opts
+	setDefault(&o.Protocol, "http")
+	if o.MaxBitrate == 0 {
+		o.MaxBitrate = 320
+	}
+
+	container, err := transcodeTarget("container", profile.Containers, musicTranscodeContainers)
+	if err != nil {
+		return "", err
+	}
+	audioCodec, err := transcodeTarget("audio codec", profile.AudioCodecs, musicTranscodeAudioCodecs)
+	if err != nil {
+		return "", err
+	}
+	params, err := c.transcodeParams(track.Key, &o, url.Values{
+		"type":       {"musicProfile"},
+		"context":    {"streaming"},
+		"protocol":   {o.Protocol},
+		"container":  {container},
+		"audioCodec": {audioCodec},
+	})
+	if err != nil {
+		return "", err
+	}
+	params.Set("musicBitrate", strconv.Itoa(o.MaxBitrate))
+	return c.URL("/music/:/transcode/universal/start?" + params.Encode()), nil
+}
+
+// VideoTranscodeURL returns the URL of a stream of video transcoded by the
+// server's universal transcoder, for players that cannot direct play it. The
+// stream uses the first container, video codec and audio codec in profile the
+// transcoder can produce.
+func (c *ServerClient) VideoTranscodeURL(video *Video, profile *DecodeProfile, opts *TranscodeOptions) (string, error) {
+	if profile == nil || opts == nil {
+		return "", errors.New("missing decode profile or transcode options")
+	}
+	o := *opts
+	setDefault(&o.Protocol, "hls")
+	if o.MaxBitrate == 0 {
+		o.MaxBitrate = 4000
+	}
+
+	container, err := transcodeTarget("container", profile.Containers, videoTranscodeContainers)
+	if err != nil {
+		return "", err
+	}
+	videoCodec, err := transcodeTarget("video codec", profile.VideoCodecs, videoTranscodeVideoCodecs)
+	if err != nil {
+		return "", err
+	}
+	audioCodec, err := transcodeTarget("audio codec", profile.AudioCodecs, videoTranscodeAudioCodecs)
+	if err != nil {
+		return "", err
+	}
+	params, err := c.transcodeParams(video.Key, &o, url.Values{
+		"type":       {"videoProfile"},
+		"context":    {"streaming"},
+		"protocol":   {o.Protocol},
+		"container":  {container},
+		"videoCodec": {videoCodec},
+		"audioCodec": {audioCodec},
+	})
+	if err != nil {
+		return "", err
+	}
+	params.Set("maxVideoBitrate", strconv.Itoa(o.MaxBitrate))
+	return c.URL("/video/:/transcode/universal/start?" + params.Encode()), nil
+}
+
+// transcodeParams returns the parameters common to music and video transcode
+// requests. target describes the stream the player wants, and is passed to
+// the server as an addition to the generic client profile.
+func (c *ServerClient) transcodeParams(key string, o *TranscodeOptions, target url.Values) (url.Values, error) {
+	if o.Session == "" {
+		return nil, errors.New("missing transcode session")
+	}
+	params := url.Values{
+		"path":                      {key},
+		"mediaIndex":                {"0"},
+		"partIndex":                 {"0"},
+		"protocol":                  {o.Protocol},
+		"offset":                    {strconv.FormatUint(o.Offset/1000, 10)},
+		"directPlay":                {"0"},
+		"directStream":              {"1"},
+		"session":                   {o.Session},
+		"X-Plex-Session-Identifier": {o.Session},
+		"X-Plex-Platform":           {"Generic"},
+		"X-Plex-Client-Profile-Extra": {
+			fmt.Sprintf("add-transcode-target(%s)", target.Encode()),
+		},
+	}
+	if c.ClientIdentifier != "" {
+		params.Set("X-Plex-Client-Identifier", c.ClientIdentifier)
+	}
+	return params, nil
+}
+
+func setDefault(s *string, value string) {
+	if *s == "" {
+		*s = value
+	}
+}